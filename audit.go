@@ -0,0 +1,398 @@
+package sqlitekv
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+// ErrNoAuditInfo is returned by writes to a collection that requires audit
+// info when neither the context nor the options provide an actor.
+var ErrNoAuditInfo = errors.New("write has no audit info")
+
+// AuditInfo describes who made a write and why.
+type AuditInfo struct {
+	ActorID   string `json:"actor_id,omitempty"`
+	RequestID string `json:"request_id,omitempty"`
+	Reason    string `json:"reason,omitempty"`
+}
+
+type auditInfoKey struct{}
+
+// WithAuditInfo returns a context that makes the *Context write methods
+// record info in the audit log.
+func WithAuditInfo(ctx context.Context, info AuditInfo) context.Context {
+	return context.WithValue(ctx, auditInfoKey{}, info)
+}
+
+func AuditInfoFromContext(ctx context.Context) (info AuditInfo, ok bool) {
+	info, ok = ctx.Value(auditInfoKey{}).(AuditInfo)
+	return
+}
+
+// AuditOptions enable the append-only audit table <table>_audit. Each write
+// made through the collection adds a row with the operation, the key, the
+// AuditInfo and a diff of the decoded values, in the write's transaction.
+// Writes made outside the collection, e.g. in SQL, are not audited.
+type AuditOptions struct {
+	// Default is recorded for writes whose context has no AuditInfo.
+	Default AuditInfo `json:"default,omitempty"`
+	// Require fails writes that end up without an actor.
+	Require bool `json:"require,omitempty"`
+	// Redact lists value paths whose old and new values are not recorded,
+	// only that they changed. Encrypted and blind-indexed fields are always
+	// redacted, and so is everything in collections using Encrypt.
+	Redact []string `json:"redact,omitempty"`
+}
+
+// FieldChange is one entry of an audit diff. Redacted changes have neither
+// value.
+type FieldChange struct {
+	Old      any  `json:"old,omitempty"`
+	New      any  `json:"new,omitempty"`
+	Redacted bool `json:"redacted,omitempty"`
+}
+
+type AuditEntry struct {
+	ID   int64
+	Time time.Time
+	Op   ChangeOp
+	Key  any
+	AuditInfo
+	// Diff is keyed by dotted value path; a value that isn't a map is
+	// keyed by "".
+	Diff map[string]FieldChange
+}
+
+// AuditQuery selects audit entries. Zero fields match everything; the time
+// range includes From and excludes To.
+type AuditQuery struct {
+	Key       any
+	Actor     string
+	RequestID string
+	From      time.Time
+	To        time.Time
+	// Limit returns at most that many of the most recent entries.
+	Limit int
+}
+
+func (kv *KeyVal[T]) AuditTableName() string {
+	return kv.tab.Name + "_audit"
+}
+
+// syncAudit creates the audit table, its indexes and the triggers that keep
+// it append-only. Turning auditing off keeps them.
+func (kv *KeyVal[T]) syncAudit() (err error) {
+	if kv.opts.Audit == nil {
+		return
+	}
+
+	kv.auditRedact = slices.Clone(kv.opts.Audit.Redact)
+	for _, f := range kv.opts.Fields {
+		if f.Encrypted || f.BlindIndex {
+			kv.auditRedact = append(kv.auditRedact, valuePath(f))
+		}
+	}
+
+	audit := kv.AuditTableName()
+	tx, err := kv.db.Begin()
+	if err != nil {
+		return
+	}
+	defer tx.Rollback()
+
+	for _, s := range []string{
+		fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (id INTEGER PRIMARY KEY AUTOINCREMENT, ts INTEGER NOT NULL,
+			op TEXT NOT NULL, key %s NOT NULL, actor TEXT, request_id TEXT, reason TEXT, diff TEXT NOT NULL)`,
+			audit, kv.opts.KeyField.Type),
+		fmt.Sprintf("CREATE INDEX IF NOT EXISTS %[1]s_key_idx ON %[1]s (key, id)", audit),
+		fmt.Sprintf("CREATE INDEX IF NOT EXISTS %[1]s_actor_idx ON %[1]s (actor, ts)", audit),
+		fmt.Sprintf("CREATE INDEX IF NOT EXISTS %[1]s_ts_idx ON %[1]s (ts)", audit),
+		fmt.Sprintf(`CREATE TRIGGER IF NOT EXISTS %[1]s_bu BEFORE UPDATE ON %[1]s BEGIN
+	SELECT RAISE(ABORT, 'audit log is append-only');
+END`, audit),
+		fmt.Sprintf(`CREATE TRIGGER IF NOT EXISTS %[1]s_bd BEFORE DELETE ON %[1]s BEGIN
+	SELECT RAISE(ABORT, 'audit log is append-only');
+END`, audit),
+	} {
+		_, err = tx.Exec(s)
+		if err != nil {
+			return
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (kv *KeyVal[T]) auditStmt() (*sql.Stmt, error) {
+	return kv.tab.StmtStore().GetOrCreate(kv.db, "audit_insert", func() string {
+		return fmt.Sprintf("INSERT INTO %s (ts, op, key, actor, request_id, reason, diff) VALUES (?, ?, ?, ?, ?, ?, ?)",
+			kv.AuditTableName())
+	})
+}
+
+// auditInfo returns the AuditInfo of ctx, or the collection's default.
+func (kv *KeyVal[T]) auditInfo(ctx context.Context) (info AuditInfo, err error) {
+	info, ok := AuditInfoFromContext(ctx)
+	if !ok {
+		info = kv.opts.Audit.Default
+	}
+	if kv.opts.Audit.Require && info.ActorID == "" {
+		err = ErrNoAuditInfo
+	}
+	return
+}
+
+func (kv *KeyVal[T]) writeAudit(ctx context.Context, tx *sql.Tx, info AuditInfo, events []Event[T]) (err error) {
+	stmt, err := kv.auditStmt()
+	if err != nil {
+		return
+	}
+	stmt = tx.StmtContext(ctx, stmt)
+
+	ts := time.Now().UnixMilli()
+	for _, ev := range events {
+		diff := map[string]FieldChange{}
+		if ev.op != OpSoftDelete {
+			diff, err = kv.auditDiff(ev.Old, ev.New)
+			if err != nil {
+				return
+			}
+		}
+
+		var buf []byte
+		buf, err = json.Marshal(diff)
+		if err != nil {
+			return
+		}
+
+		_, err = stmt.ExecContext(ctx, ts, string(ev.op), ev.Key,
+			nullString(info.ActorID), nullString(info.RequestID), nullString(info.Reason), string(buf))
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
+
+// auditDiff compares old and new as untyped values, either of which may be
+// nil.
+func (kv *KeyVal[T]) auditDiff(old, new *T) (diff map[string]FieldChange, err error) {
+	a, err := untypedValue(old)
+	if err != nil {
+		return
+	}
+	b, err := untypedValue(new)
+	if err != nil {
+		return
+	}
+
+	diff = map[string]FieldChange{}
+	diffValues("", a, b, diff)
+
+	for path := range diff {
+		if kv.opts.Encrypt || redacted(path, kv.auditRedact) {
+			diff[path] = FieldChange{Redacted: true}
+		}
+	}
+	return
+}
+
+// valuePath returns the path of f inside the untyped value: its Path, or
+// the CBOR name of the struct field that GetPtr points to, or its column
+// name.
+func valuePath[T any](f *KeyValField[T]) (path string) {
+	if f.Path != "" {
+		return f.Path
+	}
+	path = f.Name
+	if f.GetPtr == nil {
+		return
+	}
+
+	defer func() {
+		// GetPtr may dereference nil pointers of a zero T.
+		recover()
+	}()
+
+	var obj T
+	root := reflect.ValueOf(&obj).Elem()
+	ptr := reflect.ValueOf(f.GetPtr(&obj))
+	if root.Kind() != reflect.Struct || ptr.Kind() != reflect.Pointer || ptr.IsNil() {
+		return
+	}
+
+	if p, ok := structPath(root, ptr.Pointer(), ptr.Type().Elem()); ok {
+		path = p
+	}
+	return
+}
+
+// structPath finds the field of v at addr with type typ and returns its
+// path, following the field naming of the cbor package.
+func structPath(v reflect.Value, addr uintptr, typ reflect.Type) (path string, ok bool) {
+	for i := range v.NumField() {
+		sf := v.Type().Field(i)
+		if !sf.IsExported() && !(sf.Anonymous && sf.Type.Kind() == reflect.Struct) {
+			continue
+		}
+
+		tag, hasTag := sf.Tag.Lookup("cbor")
+		if !hasTag {
+			tag = sf.Tag.Get("json")
+		}
+		name, _, _ := strings.Cut(tag, ",")
+		if name == "-" {
+			continue
+		}
+		flatten := sf.Anonymous && name == ""
+		if name == "" {
+			name = sf.Name
+		}
+
+		fv := v.Field(i)
+		start := fv.UnsafeAddr()
+		if start == addr && sf.Type == typ {
+			return name, true
+		}
+
+		if fv.Kind() == reflect.Struct && addr >= start && addr < start+sf.Type.Size() {
+			path, ok = structPath(fv, addr, typ)
+			if ok && !flatten {
+				path = name + "." + path
+			}
+			return
+		}
+	}
+	return
+}
+
+func untypedValue[T any](obj *T) (v any, err error) {
+	if obj == nil {
+		return
+	}
+
+	buf, err := cbor.Marshal(obj)
+	if err != nil {
+		return
+	}
+	err = untypedDecMode.Unmarshal(buf, &v)
+	return
+}
+
+// diffValues adds the differences between a and b to diff, descending into
+// maps.
+func diffValues(path string, a, b any, diff map[string]FieldChange) {
+	am, aMap := a.(map[string]any)
+	bm, bMap := b.(map[string]any)
+	if (aMap || bMap) && (aMap || a == nil) && (bMap || b == nil) {
+		for k, v := range am {
+			diffValues(joinPath(path, k), v, bm[k], diff)
+		}
+		for k, v := range bm {
+			if _, ok := am[k]; !ok {
+				diffValues(joinPath(path, k), nil, v, diff)
+			}
+		}
+		return
+	}
+
+	if !reflect.DeepEqual(a, b) {
+		diff[path] = FieldChange{Old: a, New: b}
+	}
+}
+
+func joinPath(path, k string) string {
+	if path == "" {
+		return k
+	}
+	return path + "." + k
+}
+
+func redacted(path string, redact []string) bool {
+	for _, p := range redact {
+		if path == p || strings.HasPrefix(path, p+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// AuditLog returns the audit entries matching q, oldest first.
+func (kv *KeyVal[T]) AuditLog(q AuditQuery) (list []*AuditEntry, err error) {
+	if kv.opts.Audit == nil {
+		return nil, fmt.Errorf("collection %s is not audited", kv.tab.Name)
+	}
+
+	var where []string
+	var args []any
+	if q.Key != nil {
+		where = append(where, "key = ?")
+		args = append(args, q.Key)
+	}
+	if q.Actor != "" {
+		where = append(where, "actor = ?")
+		args = append(args, q.Actor)
+	}
+	if q.RequestID != "" {
+		where = append(where, "request_id = ?")
+		args = append(args, q.RequestID)
+	}
+	if !q.From.IsZero() {
+		where = append(where, "ts >= ?")
+		args = append(args, q.From.UnixMilli())
+	}
+	if !q.To.IsZero() {
+		where = append(where, "ts < ?")
+		args = append(args, q.To.UnixMilli())
+	}
+
+	sqlStr := "SELECT id, ts, op, key, actor, request_id, reason, diff FROM " + kv.AuditTableName()
+	if len(where) > 0 {
+		sqlStr += " WHERE " + strings.Join(where, " AND ")
+	}
+	sqlStr += " ORDER BY id DESC"
+	if q.Limit > 0 {
+		sqlStr += fmt.Sprintf(" LIMIT %d", q.Limit)
+	}
+
+	list = make([]*AuditEntry, 0)
+	err = kv.tab.Select(sqlStr, args, func(rows *sql.Rows) (err error) {
+		var e AuditEntry
+		var ts int64
+		var actor, requestID, reason sql.NullString
+		var diff string
+		err = rows.Scan(&e.ID, &ts, &e.Op, &e.Key, &actor, &requestID, &reason, &diff)
+		if err != nil {
+			return
+		}
+
+		e.Time = time.UnixMilli(ts)
+		e.ActorID, e.RequestID, e.Reason = actor.String, requestID.String, reason.String
+		err = json.Unmarshal([]byte(diff), &e.Diff)
+		if err != nil {
+			return fmt.Errorf("audit entry %d: %w", e.ID, err)
+		}
+
+		list = append(list, &e)
+		return
+	})
+	if err != nil {
+		return
+	}
+
+	slices.Reverse(list)
+	return
+}
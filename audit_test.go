@@ -0,0 +1,116 @@
+package sqlitekv
+
+import (
+	"context"
+	"testing"
+)
+
+type auditContact struct {
+	Phone string `cbor:"phone"`
+}
+
+type auditMeta struct {
+	Source string
+}
+
+type auditRecord struct {
+	auditMeta
+	Id      int64 `json:"id"`
+	Email   string
+	Contact auditContact `json:"contact"`
+	Skipped string       `json:"-"`
+}
+
+func TestValuePath(t *testing.T) {
+	field := func(name string, ptr func(r *auditRecord) any) *KeyValField[auditRecord] {
+		return &KeyValField[auditRecord]{Name: name, GetPtr: ptr}
+	}
+
+	for _, c := range []struct {
+		f    *KeyValField[auditRecord]
+		want string
+	}{
+		{field("email", func(r *auditRecord) any { return &r.Email }), "Email"},
+		{field("id", func(r *auditRecord) any { return &r.Id }), "id"},
+		{field("phone", func(r *auditRecord) any { return &r.Contact.Phone }), "contact.phone"},
+		{field("source", func(r *auditRecord) any { return &r.Source }), "Source"},
+		{field("other", func(r *auditRecord) any { return new(string) }), "other"},
+		{&KeyValField[auditRecord]{Name: "email", Path: "x.y"}, "x.y"},
+	} {
+		if got := valuePath(c.f); got != c.want {
+			t.Errorf("valuePath(%s) = %q, want %q", c.f.Name, got, c.want)
+		}
+	}
+
+	doc := documentField(FieldSpec{Name: "email", Type: "TEXT"})
+	if got := valuePath(doc); got != "email" {
+		t.Errorf("document valuePath = %q", got)
+	}
+}
+
+func TestAuditRedactsSensitiveFields(t *testing.T) {
+	db := openTestDB(t)
+	email := emailField()
+	email.BlindIndex = true
+	kv, err := NewKeyVal(db, "users", KeyValOptions[testUser]{
+		KeyField: userKeyField(),
+		Fields:   []*KeyValField[testUser]{email},
+		Enc:      testEncoder(t, db, EncoderOptions{Keys: testKeys()}),
+		Encrypt:  true,
+		Audit:    &AuditOptions{},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := WithAuditInfo(context.Background(), AuditInfo{ActorID: "alice"})
+	err = kv.UpsertContext(ctx, &testUser{Id: 1, Name: "a", Email: "a@b.c"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = kv.UpsertContext(ctx, &testUser{Id: 1, Name: "a", Email: "new@b.c"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	list, err := kv.AuditLog(AuditQuery{Key: 1, Actor: "alice"})
+	if err != nil || len(list) != 2 {
+		t.Fatalf("AuditLog = %v, %v", list, err)
+	}
+	if c := list[1].Diff["email"]; !c.Redacted || c.Old != nil || c.New != nil {
+		t.Errorf("email change = %+v", c)
+	}
+
+	var n int
+	err = db.QueryRow(`SELECT COUNT(*) FROM users_audit WHERE diff LIKE '%@b.c%'`).Scan(&n)
+	if err != nil || n != 0 {
+		t.Errorf("plaintext in audit log: %d, %v", n, err)
+	}
+}
+
+func TestAuditRedactsByValuePath(t *testing.T) {
+	db := openTestDB(t)
+	kv, err := NewKeyVal(db, "records", KeyValOptions[auditRecord]{
+		KeyField: &KeyValField[auditRecord]{Name: "id", Type: "INTEGER",
+			Get: func(r *auditRecord) any { return r.Id }, GetPtr: func(r *auditRecord) any { return &r.Id }},
+		Enc:   testEncoder(t, db, EncoderOptions{}),
+		Audit: &AuditOptions{Redact: []string{"contact"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = kv.Upsert(&auditRecord{Id: 1, Email: "a@b.c", Contact: auditContact{Phone: "123"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	list, err := kv.AuditLog(AuditQuery{})
+	if err != nil || len(list) != 1 {
+		t.Fatalf("AuditLog = %v, %v", list, err)
+	}
+	diff := list[0].Diff
+	if !diff["contact.phone"].Redacted || diff["Email"].New != "a@b.c" {
+		t.Errorf("diff = %+v", diff)
+	}
+}
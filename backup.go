@@ -0,0 +1,306 @@
+package sqlitekv
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+	"github.com/valyala/gozstd"
+)
+
+var ErrDatabaseInUse = errors.New("database is in use")
+
+type BackupProgress struct {
+	Remaining int
+	PageCount int
+}
+
+type BackupOptions struct {
+	// PagesPerStep is the number of pages copied per step, 100 by default.
+	// A negative value copies everything in one step.
+	PagesPerStep int
+	// StepDelay pauses between steps so that writers to the source get a
+	// chance to run.
+	StepDelay time.Duration
+	Progress  func(BackupProgress)
+	// Overwrite lets Restore replace an existing database file.
+	Overwrite bool
+}
+
+// Backup copies the live database behind db to destPath using SQLite's
+// online backup API, which is consistent under WAL and concurrent writers.
+// The copy is switched to rollback journal mode so that it is a single
+// self-contained file.
+func Backup(ctx context.Context, db *sql.DB, destPath string, opts BackupOptions) (err error) {
+	destDB, err := sql.Open("sqlite3", destPath)
+	if err != nil {
+		return
+	}
+	defer destDB.Close()
+
+	err = copyDatabase(ctx, db, destDB, opts)
+	if err != nil {
+		return
+	}
+
+	_, err = destDB.ExecContext(ctx, "PRAGMA journal_mode=DELETE")
+	if err != nil {
+		return
+	}
+
+	return destDB.Close()
+}
+
+// Restore replaces the database at destPath with the backup at srcPath. The
+// backup is first copied next to destPath and validated. A new destPath is
+// created by renaming the copy; an existing one is overwritten in place with
+// the online backup API, so connections that have it open see the restored
+// content, though collections opened on them should be reopened. If they
+// keep it locked, Restore fails with ErrDatabaseInUse. The validation has no
+// kv functions, so path indexes are not compared with their tables.
+func Restore(ctx context.Context, srcPath string, destPath string, opts BackupOptions) (err error) {
+	_, err = os.Stat(destPath)
+	exists := err == nil
+	if exists && !opts.Overwrite {
+		return fmt.Errorf("restore destination %s exists", destPath)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return
+	}
+
+	_, err = os.Stat(srcPath)
+	if err != nil {
+		return
+	}
+
+	srcDB, err := sql.Open("sqlite3", srcPath)
+	if err != nil {
+		return
+	}
+	defer srcDB.Close()
+
+	tmpPath := destPath + ".restore"
+	os.Remove(tmpPath)
+	defer os.Remove(tmpPath)
+
+	tmpDB, err := sql.Open("sqlite3", tmpPath)
+	if err != nil {
+		return
+	}
+	defer tmpDB.Close()
+
+	err = copyDatabase(ctx, srcDB, tmpDB, opts)
+	if err != nil {
+		return
+	}
+
+	err = validateDatabase(ctx, tmpDB)
+	if err != nil {
+		return fmt.Errorf("restored database is invalid: %w", err)
+	}
+
+	if !exists {
+		err = tmpDB.Close()
+		if err != nil {
+			return
+		}
+		return os.Rename(tmpPath, destPath)
+	}
+
+	destDB, err := sql.Open("sqlite3", destPath)
+	if err != nil {
+		return
+	}
+	defer destDB.Close()
+
+	// A single step holds the write lock on destPath for the whole copy.
+	err = copyDatabase(ctx, tmpDB, destDB, BackupOptions{PagesPerStep: -1})
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) && (sqliteErr.Code == sqlite3.ErrBusy || sqliteErr.Code == sqlite3.ErrLocked) {
+		return fmt.Errorf("%w: %v", ErrDatabaseInUse, err)
+	}
+	if err != nil {
+		return
+	}
+
+	return destDB.Close()
+}
+
+func copyDatabase(ctx context.Context, srcDB *sql.DB, destDB *sql.DB, opts BackupOptions) (err error) {
+	pages := opts.PagesPerStep
+	if pages == 0 {
+		pages = 100
+	}
+
+	srcConn, err := srcDB.Conn(ctx)
+	if err != nil {
+		return
+	}
+	defer srcConn.Close()
+
+	destConn, err := destDB.Conn(ctx)
+	if err != nil {
+		return
+	}
+	defer destConn.Close()
+
+	return destConn.Raw(func(destDriverConn any) error {
+		return srcConn.Raw(func(srcDriverConn any) error {
+			dest, ok := destDriverConn.(*sqlite3.SQLiteConn)
+			if !ok {
+				return fmt.Errorf("backup needs a go-sqlite3 connection, got %T", destDriverConn)
+			}
+			src, ok := srcDriverConn.(*sqlite3.SQLiteConn)
+			if !ok {
+				return fmt.Errorf("backup needs a go-sqlite3 connection, got %T", srcDriverConn)
+			}
+
+			return stepBackup(ctx, dest, src, pages, opts)
+		})
+	})
+}
+
+func stepBackup(ctx context.Context, dest *sqlite3.SQLiteConn, src *sqlite3.SQLiteConn, pages int, opts BackupOptions) (err error) {
+	bk, err := dest.Backup("main", src, "main")
+	if err != nil {
+		return
+	}
+
+	for {
+		var done bool
+		done, err = bk.Step(pages)
+		if err != nil {
+			bk.Finish()
+			return
+		}
+
+		if opts.Progress != nil {
+			opts.Progress(BackupProgress{Remaining: bk.Remaining(), PageCount: bk.PageCount()})
+		}
+
+		if done {
+			return bk.Finish()
+		}
+
+		select {
+		case <-ctx.Done():
+			bk.Finish()
+			return ctx.Err()
+		case <-time.After(opts.StepDelay):
+		}
+	}
+}
+
+// validateDatabase runs an integrity check, reads every table in the schema
+// and checks that every stored dictionary is a loadable zstd dictionary.
+func validateDatabase(ctx context.Context, db *sql.DB) (err error) {
+	problems, err := integrityCheck(ctx, db)
+	if err != nil {
+		return
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("integrity check: %s", problems[0])
+	}
+
+	tables, err := schemaTables(ctx, db)
+	if err != nil {
+		return
+	}
+
+	hasDicts, hasCatalog := false, false
+	for _, name := range tables {
+		var n int64
+		err = db.QueryRowContext(ctx, fmt.Sprintf(`SELECT COUNT(*) FROM "%s"`, name)).Scan(&n)
+		if err != nil {
+			return fmt.Errorf("table %s: %w", name, err)
+		}
+		hasDicts = hasDicts || name == "comp_dict"
+		hasCatalog = hasCatalog || name == "kv_catalog"
+	}
+
+	if hasDicts {
+		err = validateDicts(ctx, db)
+		if err != nil {
+			return
+		}
+	}
+
+	if hasCatalog {
+		err = validateCatalog(ctx, db, tables)
+	}
+	return
+}
+
+// validateCatalog checks that every cataloged collection has its table.
+func validateCatalog(ctx context.Context, db *sql.DB, tables []string) (err error) {
+	cat := &Catalog{db: db}
+	specs, err := cat.List()
+	if err != nil {
+		return fmt.Errorf("catalog: %w", err)
+	}
+
+	for _, spec := range specs {
+		if !slices.Contains(tables, spec.Name) {
+			return fmt.Errorf("catalog: collection %s has no table", spec.Name)
+		}
+	}
+	return
+}
+
+func schemaTables(ctx context.Context, db *sql.DB) (tables []string, err error) {
+	rows, err := db.QueryContext(ctx, `SELECT name FROM sqlite_schema
+		WHERE type = 'table' AND name NOT LIKE 'sqlite_%' ORDER BY name`)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var name string
+		err = rows.Scan(&name)
+		if err != nil {
+			return
+		}
+		tables = append(tables, name)
+	}
+
+	err = rows.Err()
+	return
+}
+
+func validateDicts(ctx context.Context, db *sql.DB) (err error) {
+	rows, err := db.QueryContext(ctx, `SELECT key, ver, dict FROM comp_dict`)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var key string
+		var ver int64
+		var buf []byte
+		err = rows.Scan(&key, &ver, &buf)
+		if err != nil {
+			return
+		}
+
+		if ver <= 0 || ver > MaxDictVer {
+			return fmt.Errorf("dictionary %s has invalid version %d", key, ver)
+		}
+
+		var ddict *gozstd.DDict
+		ddict, err = gozstd.NewDDict(buf)
+		if err != nil {
+			return fmt.Errorf("dictionary %s ver=%d: %w", key, ver, err)
+		}
+		ddict.Release()
+	}
+
+	err = rows.Err()
+	return
+}
@@ -0,0 +1,151 @@
+package sqlitekv
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRestoreWithPathIndexes(t *testing.T) {
+	db := openTestFuncDB(t)
+	enc := testEncoder(t, db, EncoderOptions{})
+	kv, err := NewKeyVal(db, "users", KeyValOptions[testUser]{
+		KeyField:    userKeyField(),
+		Enc:         enc,
+		PathIndexes: []PathIndex{{Path: "$.name"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = kv.Upsert(&testUser{Id: 1, Name: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	dir := t.TempDir()
+	backup := filepath.Join(dir, "backup.db")
+	err = Backup(ctx, db, backup, BackupOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = Restore(ctx, backup, filepath.Join(dir, "restored.db"), BackupOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func backupUsers(t *testing.T, dir string) string {
+	t.Helper()
+	db := openTestDB(t)
+	kv, err := NewKeyVal(db, "users", KeyValOptions[testUser]{
+		KeyField: userKeyField(),
+		Enc:      testEncoder(t, db, EncoderOptions{}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = kv.Upsert(&testUser{Id: 1, Name: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "backup.db")
+	err = Backup(context.Background(), db, path, BackupOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func openRestoreDest(t *testing.T, path string, journalMode string) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("sqlite3", "file:"+path+"?_journal_mode="+journalMode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	_, err = db.Exec("CREATE TABLE old (x); INSERT INTO old VALUES (1)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestRestoreOverOpenDatabase(t *testing.T) {
+	for _, mode := range []string{"DELETE", "WAL"} {
+		t.Run(mode, func(t *testing.T) {
+			dir := t.TempDir()
+			backup := backupUsers(t, dir)
+			dest := filepath.Join(dir, "dest.db")
+			db := openRestoreDest(t, dest, mode)
+
+			err := Restore(context.Background(), backup, dest, BackupOptions{Overwrite: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var n int
+			err = db.QueryRow("SELECT COUNT(*) FROM sqlite_schema WHERE name = 'old'").Scan(&n)
+			if err != nil || n != 0 {
+				t.Errorf("old table still there: %d, %v", n, err)
+			}
+			err = db.QueryRow("SELECT COUNT(*) FROM users").Scan(&n)
+			if err != nil || n != 1 {
+				t.Errorf("open handle sees %d users, %v", n, err)
+			}
+		})
+	}
+}
+
+func TestRestoreKeepsDestination(t *testing.T) {
+	dir := t.TempDir()
+	backup := backupUsers(t, dir)
+
+	garbage := filepath.Join(dir, "garbage.db")
+	err := os.WriteFile(garbage, make([]byte, 8192), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	noTable := backupUsers(t, t.TempDir())
+	db, err := sql.Open("sqlite3", noTable)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec("DROP TABLE users")
+	db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name string
+		src  string
+		opts BackupOptions
+	}{
+		{"overwrite off", backup, BackupOptions{}},
+		{"not a database", garbage, BackupOptions{Overwrite: true}},
+		{"cataloged table missing", noTable, BackupOptions{Overwrite: true}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dest := filepath.Join(t.TempDir(), "dest.db")
+			db := openRestoreDest(t, dest, "DELETE")
+
+			err := Restore(context.Background(), tc.src, dest, tc.opts)
+			if err == nil {
+				t.Fatal("Restore succeeded")
+			}
+
+			var n int
+			err = db.QueryRow("SELECT COUNT(*) FROM old").Scan(&n)
+			if err != nil || n != 1 {
+				t.Errorf("destination changed: %d, %v", n, err)
+			}
+		})
+	}
+}
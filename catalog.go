@@ -0,0 +1,169 @@
+package sqlitekv
+
+import (
+	"database/sql"
+	"encoding/json"
+	"time"
+)
+
+// FieldSpec and CollectionSpec describe a collection's layout in the
+// catalog, so that tools can open it without the Go type.
+type FieldSpec struct {
+	Name       string `json:"name"`
+	Type       string `json:"type"`
+	Unique     bool   `json:"unique,omitempty"`
+	Nullable   bool   `json:"nullable,omitempty"`
+	Indexed    bool   `json:"indexed,omitempty"`
+	Encrypted  bool   `json:"encrypted,omitempty"`
+	BlindIndex bool   `json:"blind_index,omitempty"`
+	FullText   bool   `json:"full_text,omitempty"`
+	Geo        bool   `json:"geo,omitempty"`
+	// VectorDims and VectorMetric describe vector fields.
+	VectorDims   int          `json:"vector_dims,omitempty"`
+	VectorMetric VectorMetric `json:"vector_metric,omitempty"`
+	Path         string       `json:"path,omitempty"`
+}
+
+type CollectionSpec struct {
+	Name        string              `json:"name"`
+	Key         FieldSpec           `json:"key"`
+	Fields      []FieldSpec         `json:"fields,omitempty"`
+	DictKey     string              `json:"dict_key,omitempty"`
+	Compression bool                `json:"compression,omitempty"`
+	UseDict     bool                `json:"use_dict,omitempty"`
+	Encrypt     bool                `json:"encrypt,omitempty"`
+	Checksum    bool                `json:"checksum,omitempty"`
+	JSONView    bool                `json:"json_view,omitempty"`
+	PathIndexes []PathIndex         `json:"path_indexes,omitempty"`
+	VectorIndex *VectorIndexOptions `json:"vector_index,omitempty"`
+	ChangeLog   *ChangeLogOptions   `json:"change_log,omitempty"`
+	KeepHistory bool                `json:"keep_history,omitempty"`
+	Audit       *AuditOptions       `json:"audit,omitempty"`
+}
+
+type Catalog struct {
+	db *sql.DB
+}
+
+func NewCatalog(db *sql.DB) (c *Catalog, err error) {
+	c = &Catalog{db: db}
+	err = c.init()
+	return
+}
+
+func (c *Catalog) init() (err error) {
+	_, err = c.db.Exec(`
+	CREATE TABLE IF NOT EXISTS kv_catalog (
+		name TEXT PRIMARY KEY,
+		spec TEXT NOT NULL,
+		updated INTEGER NOT NULL
+	)`)
+	return
+}
+
+// Put stores spec and reports whether it differs from what was stored.
+func (c *Catalog) Put(spec CollectionSpec) (changed bool, err error) {
+	buf, err := json.Marshal(spec)
+	if err != nil {
+		return
+	}
+
+	res, err := c.db.Exec(`INSERT INTO kv_catalog (name, spec, updated) VALUES (?, ?, ?)
+		ON CONFLICT(name) DO UPDATE SET spec=excluded.spec, updated=excluded.updated
+		WHERE spec != excluded.spec`, spec.Name, string(buf), time.Now().Unix())
+	if err != nil {
+		return
+	}
+
+	n, err := res.RowsAffected()
+	changed = n > 0
+	return
+}
+
+func (c *Catalog) Get(name string) (ok bool, spec CollectionSpec, err error) {
+	var buf string
+	row := c.db.QueryRow(`SELECT spec FROM kv_catalog WHERE name = ?`, name)
+	err = row.Scan(&buf)
+	if err == sql.ErrNoRows {
+		err = nil
+		return
+	}
+	if err != nil {
+		return
+	}
+
+	err = json.Unmarshal([]byte(buf), &spec)
+	ok = err == nil
+	return
+}
+
+func (c *Catalog) List() (specs []CollectionSpec, err error) {
+	rows, err := c.db.Query(`SELECT spec FROM kv_catalog ORDER BY name`)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var buf string
+		err = rows.Scan(&buf)
+		if err != nil {
+			return
+		}
+
+		var spec CollectionSpec
+		err = json.Unmarshal([]byte(buf), &spec)
+		if err != nil {
+			return
+		}
+		specs = append(specs, spec)
+	}
+
+	err = rows.Err()
+	return
+}
+
+func (c *Catalog) Delete(name string) (err error) {
+	_, err = c.db.Exec(`DELETE FROM kv_catalog WHERE name = ?`, name)
+	return
+}
+
+func fieldSpec[T any](f *KeyValField[T]) FieldSpec {
+	return FieldSpec{
+		Name:         f.Name,
+		Type:         f.Type,
+		Unique:       f.Unique,
+		Nullable:     f.Nullable,
+		Indexed:      f.Indexed,
+		Encrypted:    f.Encrypted,
+		BlindIndex:   f.BlindIndex,
+		FullText:     f.FullText,
+		Geo:          f.Geo,
+		VectorDims:   f.VectorDims,
+		VectorMetric: f.VectorMetric,
+		Path:         valuePath(f),
+	}
+}
+
+func (kv *KeyVal[T]) Spec() (spec CollectionSpec) {
+	spec = CollectionSpec{
+		Name:        kv.tab.Name,
+		Key:         fieldSpec(kv.opts.KeyField),
+		DictKey:     kv.opts.DictKey,
+		Compression: kv.opts.Compression,
+		UseDict:     kv.opts.UseDict,
+		Encrypt:     kv.opts.Encrypt,
+		Checksum:    kv.opts.Checksum,
+		JSONView:    kv.opts.JSONView,
+		PathIndexes: kv.opts.PathIndexes,
+		VectorIndex: kv.opts.VectorIndex,
+		ChangeLog:   kv.opts.ChangeLog,
+		KeepHistory: kv.opts.KeepHistory,
+		Audit:       kv.opts.Audit,
+	}
+
+	for _, f := range kv.opts.Fields {
+		spec.Fields = append(spec.Fields, fieldSpec(f))
+	}
+	return
+}
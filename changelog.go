@@ -0,0 +1,374 @@
+package sqlitekv
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"iter"
+	"strings"
+	"time"
+)
+
+// ErrChangesTrimmed is returned when changes after the requested sequence
+// number were already trimmed from the change log.
+var ErrChangesTrimmed = errors.New("changes were trimmed")
+
+type ChangeOp string
+
+const (
+	OpInsert     ChangeOp = "insert"
+	OpUpdate     ChangeOp = "update"
+	OpDelete     ChangeOp = "delete"
+	OpSoftDelete ChangeOp = "soft_delete"
+	OpUndelete   ChangeOp = "undelete"
+)
+
+// ChangeLogOptions enable the change log table <table>_changes. Entries are
+// written by triggers, so they commit or roll back with the change.
+type ChangeLogOptions struct {
+	// IncludeValue stores the encoded value with inserts and updates.
+	IncludeValue bool `json:"include_value,omitempty"`
+	// Retention and MaxEntries bound the log when TrimChanges runs, even
+	// for consumers that have not caught up.
+	Retention  time.Duration `json:"retention,omitempty"`
+	MaxEntries int64         `json:"max_entries,omitempty"`
+}
+
+type Change[T any] struct {
+	Seq  int64
+	Op   ChangeOp
+	Key  any
+	Time time.Time
+	// Value is the new value when the log includes values; nil for deletes.
+	Value *T
+}
+
+const changesPageSize = 500
+
+func (kv *KeyVal[T]) ChangeLogTableName() string {
+	return kv.tab.Name + "_changes"
+}
+
+func (kv *KeyVal[T]) changeLogTriggers() []string {
+	changes := kv.ChangeLogTableName()
+	key := kv.opts.KeyField.Name
+	now := "CAST(unixepoch('subsec') * 1000 AS INTEGER)"
+
+	newVal := "NULL, NULL"
+	if kv.opts.ChangeLog.IncludeValue {
+		newVal = "new.flags, new.val"
+	}
+
+	return []string{
+		fmt.Sprintf(`CREATE TRIGGER %[1]s_ai AFTER INSERT ON %[2]s BEGIN
+	INSERT INTO %[1]s (op, key, ts, flags, val) VALUES ('insert', new.%[3]s, %[4]s, %[5]s);
+END`, changes, kv.tab.Name, key, now, newVal),
+		fmt.Sprintf(`CREATE TRIGGER %[1]s_au AFTER UPDATE ON %[2]s BEGIN
+	INSERT INTO %[1]s (op, key, ts, flags, val) VALUES (CASE
+		WHEN old.flags & 1 = 0 AND new.flags & 1 = 1 THEN 'soft_delete'
+		WHEN old.flags & 1 = 1 AND new.flags & 1 = 0 THEN 'undelete'
+		ELSE 'update' END, new.%[3]s, %[4]s, %[5]s);
+END`, changes, kv.tab.Name, key, now, newVal),
+		fmt.Sprintf(`CREATE TRIGGER %[1]s_ad AFTER DELETE ON %[2]s BEGIN
+	INSERT INTO %[1]s (op, key, ts) VALUES ('delete', old.%[3]s, %[4]s);
+END`, changes, kv.tab.Name, key, now),
+	}
+}
+
+// syncChangeLog creates the change log table and its triggers, or drops the
+// triggers when the change log is turned off. The table is kept so that
+// consumers can finish reading it.
+func (kv *KeyVal[T]) syncChangeLog() (err error) {
+	changes := kv.ChangeLogTableName()
+
+	var want []string
+	if kv.opts.ChangeLog != nil {
+		want = kv.changeLogTriggers()
+	}
+
+	var current []string
+	rows, err := kv.db.Query(`SELECT sql FROM sqlite_master WHERE type = 'trigger' AND name IN (?, ?, ?)
+		ORDER BY name = ? DESC, name = ? DESC`,
+		changes+"_ai", changes+"_au", changes+"_ad", changes+"_ai", changes+"_au")
+	if err != nil {
+		return
+	}
+	for rows.Next() {
+		var s string
+		err = rows.Scan(&s)
+		if err != nil {
+			rows.Close()
+			return
+		}
+		current = append(current, s)
+	}
+	rows.Close()
+	err = rows.Err()
+	if err != nil {
+		return
+	}
+
+	if strings.Join(current, ";") == strings.Join(want, ";") {
+		return
+	}
+
+	tx, err := kv.db.Begin()
+	if err != nil {
+		return
+	}
+	defer tx.Rollback()
+
+	for _, s := range []string{"_ai", "_au", "_ad"} {
+		_, err = tx.Exec(fmt.Sprintf("DROP TRIGGER IF EXISTS %s%s", changes, s))
+		if err != nil {
+			return
+		}
+	}
+
+	if want != nil {
+		_, err = tx.Exec(fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+			seq INTEGER PRIMARY KEY AUTOINCREMENT,
+			op TEXT NOT NULL,
+			key,
+			ts INTEGER NOT NULL,
+			flags INTEGER,
+			val BLOB
+		)`, changes))
+		if err != nil {
+			return
+		}
+
+		for _, s := range want {
+			_, err = tx.Exec(s)
+			if err != nil {
+				return
+			}
+		}
+	}
+
+	_, err = tx.Exec(`CREATE TABLE IF NOT EXISTS kv_change_cursors (
+		tab TEXT NOT NULL,
+		name TEXT NOT NULL,
+		seq INTEGER NOT NULL,
+		updated INTEGER NOT NULL,
+		PRIMARY KEY (tab, name)
+	)`)
+	if err != nil {
+		return
+	}
+
+	return tx.Commit()
+}
+
+// firstChangeSeq returns the oldest sequence number still in the log, or
+// the next one to be assigned when the log is empty.
+func (kv *KeyVal[T]) firstChangeSeq() (seq int64, err error) {
+	err = kv.db.QueryRow(fmt.Sprintf(`SELECT COALESCE(
+		(SELECT MIN(seq) FROM %[1]s),
+		(SELECT seq + 1 FROM sqlite_sequence WHERE name = '%[1]s'),
+		1)`, kv.ChangeLogTableName())).Scan(&seq)
+	return
+}
+
+// Changes iterates over the change log entries after sinceSeq, oldest
+// first. It yields ErrChangesTrimmed if some of them were already trimmed.
+// Entries are read in pages, so the loop body may write to the collection.
+func (kv *KeyVal[T]) Changes(sinceSeq int64) iter.Seq2[*Change[T], error] {
+	return func(yield func(*Change[T], error) bool) {
+		if kv.opts.ChangeLog == nil {
+			yield(nil, fmt.Errorf("collection %s has no change log", kv.tab.Name))
+			return
+		}
+
+		first, err := kv.firstChangeSeq()
+		if err != nil {
+			yield(nil, err)
+			return
+		}
+		if sinceSeq+1 < first {
+			yield(nil, fmt.Errorf("%w: oldest available change is %d", ErrChangesTrimmed, first))
+			return
+		}
+
+		for {
+			var page []*Change[T]
+			page, err = kv.changesPage(sinceSeq)
+			if err != nil {
+				yield(nil, err)
+				return
+			}
+
+			for _, c := range page {
+				if !yield(c, nil) {
+					return
+				}
+				sinceSeq = c.Seq
+			}
+			if len(page) < changesPageSize {
+				return
+			}
+		}
+	}
+}
+
+func (kv *KeyVal[T]) changesPage(sinceSeq int64) (page []*Change[T], err error) {
+	q := fmt.Sprintf("SELECT seq, op, key, ts, flags, val FROM %s WHERE seq > ? ORDER BY seq LIMIT %d",
+		kv.ChangeLogTableName(), changesPageSize)
+
+	err = kv.tab.Select(q, []any{sinceSeq}, func(rows *sql.Rows) (err error) {
+		var c Change[T]
+		var ts int64
+		var flags sql.NullInt64
+		var val []byte
+		err = rows.Scan(&c.Seq, &c.Op, &c.Key, &ts, &flags, &val)
+		if err != nil {
+			return
+		}
+		c.Time = time.UnixMilli(ts)
+
+		if flags.Valid && val != nil {
+			var opts DecodeOptions
+			opts, err = kv.decodeOptions(flags.Int64, c.Key)
+			if err != nil {
+				return
+			}
+
+			c.Value = new(T)
+			err = kv.opts.Enc.Decode(val, c.Value, flags.Int64, opts)
+			if err != nil {
+				return fmt.Errorf("change %d: %w", c.Seq, err)
+			}
+		}
+
+		page = append(page, &c)
+		return
+	})
+	return
+}
+
+// ChangeConsumer is a named cursor into the change log whose position is
+// stored in kv_change_cursors.
+type ChangeConsumer[T any] struct {
+	kv   *KeyVal[T]
+	name string
+}
+
+// Consumer returns the named consumer, creating it positioned before the
+// oldest change still in the log.
+func (kv *KeyVal[T]) Consumer(name string) (c *ChangeConsumer[T], err error) {
+	if kv.opts.ChangeLog == nil {
+		err = fmt.Errorf("collection %s has no change log", kv.tab.Name)
+		return
+	}
+
+	first, err := kv.firstChangeSeq()
+	if err != nil {
+		return
+	}
+
+	_, err = kv.db.Exec(`INSERT INTO kv_change_cursors (tab, name, seq, updated) VALUES (?, ?, ?, ?)
+		ON CONFLICT(tab, name) DO NOTHING`, kv.tab.Name, name, first-1, time.Now().Unix())
+	if err != nil {
+		return
+	}
+
+	c = &ChangeConsumer[T]{kv: kv, name: name}
+	return
+}
+
+func (c *ChangeConsumer[T]) Name() string {
+	return c.name
+}
+
+// Seq returns the last checkpointed sequence number.
+func (c *ChangeConsumer[T]) Seq() (seq int64, err error) {
+	err = c.kv.db.QueryRow(`SELECT seq FROM kv_change_cursors WHERE tab = ? AND name = ?`,
+		c.kv.tab.Name, c.name).Scan(&seq)
+	if err == sql.ErrNoRows {
+		err = fmt.Errorf("change consumer %s was deleted", c.name)
+	}
+	return
+}
+
+// Changes iterates over the changes after the last checkpoint.
+func (c *ChangeConsumer[T]) Changes() iter.Seq2[*Change[T], error] {
+	return func(yield func(*Change[T], error) bool) {
+		seq, err := c.Seq()
+		if err != nil {
+			yield(nil, err)
+			return
+		}
+		c.kv.Changes(seq)(yield)
+	}
+}
+
+// Checkpoint records that the changes up to seq were processed.
+func (c *ChangeConsumer[T]) Checkpoint(seq int64) (err error) {
+	res, err := c.kv.db.Exec(`UPDATE kv_change_cursors SET seq = ?, updated = ? WHERE tab = ? AND name = ?`,
+		seq, time.Now().Unix(), c.kv.tab.Name, c.name)
+	if err != nil {
+		return
+	}
+
+	n, err := res.RowsAffected()
+	if err == nil && n == 0 {
+		err = fmt.Errorf("change consumer %s was deleted", c.name)
+	}
+	return
+}
+
+func (c *ChangeConsumer[T]) Delete() (err error) {
+	_, err = c.kv.db.Exec(`DELETE FROM kv_change_cursors WHERE tab = ? AND name = ?`, c.kv.tab.Name, c.name)
+	return
+}
+
+// TrimChanges deletes the changes every consumer has checkpointed, and those
+// beyond Retention and MaxEntries. Consumers that have not read the latter
+// get ErrChangesTrimmed.
+func (kv *KeyVal[T]) TrimChanges() (n int64, err error) {
+	if kv.opts.ChangeLog == nil {
+		err = fmt.Errorf("collection %s has no change log", kv.tab.Name)
+		return
+	}
+	opts := kv.opts.ChangeLog
+	changes := kv.ChangeLogTableName()
+
+	var upto sql.NullInt64
+	err = kv.db.QueryRow(`SELECT MIN(seq) FROM kv_change_cursors WHERE tab = ?`, kv.tab.Name).Scan(&upto)
+	if err != nil {
+		return
+	}
+
+	if opts.Retention > 0 {
+		var seq sql.NullInt64
+		cutoff := time.Now().Add(-opts.Retention).UnixMilli()
+		err = kv.db.QueryRow(fmt.Sprintf(`SELECT MAX(seq) FROM %s WHERE ts < ?`, changes), cutoff).Scan(&seq)
+		if err != nil {
+			return
+		}
+		if seq.Valid && seq.Int64 > upto.Int64 {
+			upto = seq
+		}
+	}
+
+	if opts.MaxEntries > 0 {
+		var seq sql.NullInt64
+		err = kv.db.QueryRow(fmt.Sprintf(`SELECT MAX(seq) - ? FROM %s`, changes), opts.MaxEntries).Scan(&seq)
+		if err != nil {
+			return
+		}
+		if seq.Valid && seq.Int64 > upto.Int64 {
+			upto = seq
+		}
+	}
+
+	if !upto.Valid {
+		return
+	}
+
+	res, err := kv.db.Exec(fmt.Sprintf(`DELETE FROM %s WHERE seq <= ?`, changes), upto.Int64)
+	if err != nil {
+		return
+	}
+	return res.RowsAffected()
+}
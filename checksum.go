@@ -0,0 +1,48 @@
+package sqlitekv
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+)
+
+// EncodeFlagChecksum marks values prefixed with the CRC32C of the stored
+// payload, i.e. after compression and encryption.
+const EncodeFlagChecksum = 0x10
+
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+type CorruptionError struct {
+	Key    any
+	Reason string
+}
+
+func (e *CorruptionError) Error() string {
+	return fmt.Sprintf("corrupt value for key %v: %s", e.Key, e.Reason)
+}
+
+func HasChecksum(flags int64) bool {
+	return flags&EncodeFlagChecksum != 0
+}
+
+func addChecksum(flags int64, buf []byte) (int64, []byte) {
+	dst := make([]byte, 4, 4+len(buf))
+	binary.BigEndian.PutUint32(dst, crc32.Checksum(buf, crc32c))
+	dst = append(dst, buf...)
+	return flags | EncodeFlagChecksum, dst
+}
+
+func verifyChecksum(src []byte, key any) (payload []byte, err error) {
+	if len(src) < 4 {
+		err = &CorruptionError{Key: key, Reason: "value too short for checksum"}
+		return
+	}
+
+	want := binary.BigEndian.Uint32(src)
+	payload = src[4:]
+	got := crc32.Checksum(payload, crc32c)
+	if got != want {
+		err = &CorruptionError{Key: key, Reason: fmt.Sprintf("checksum mismatch: stored=%08x, computed=%08x", want, got)}
+	}
+	return
+}
@@ -0,0 +1,50 @@
+package sqlitekv
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestChecksumCorruption(t *testing.T) {
+	db := openTestDB(t)
+	kv, err := NewKeyVal(db, "users", KeyValOptions[testUser]{
+		KeyField:    userKeyField(),
+		Enc:         testEncoder(t, db, EncoderOptions{}),
+		Compression: true,
+		Checksum:    true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = kv.Upsert(&testUser{Id: 1, Name: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var u testUser
+	ok, err := kv.Get(1, &u)
+	if err != nil || !ok || u.Name != "alice" {
+		t.Fatalf("Get = %+v, %v, %v", u, ok, err)
+	}
+
+	var val []byte
+	err = db.QueryRow("SELECT val FROM users WHERE id = 1").Scan(&val)
+	if err != nil {
+		t.Fatal(err)
+	}
+	val[len(val)-1] ^= 0xff
+	_, err = db.Exec("UPDATE users SET val = ? WHERE id = 1", val)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = kv.Get(1, &u)
+	var corrupt *CorruptionError
+	if !errors.As(err, &corrupt) {
+		t.Fatalf("Get error = %v, want CorruptionError", err)
+	}
+	if corrupt.Key != int64(1) {
+		t.Errorf("CorruptionError.Key = %#v", corrupt.Key)
+	}
+}
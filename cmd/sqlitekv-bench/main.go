@@ -0,0 +1,370 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/sudeep9/sqlitekv"
+)
+
+type config struct {
+	dbPath   string
+	keep     bool
+	shape    string
+	size     int
+	records  int
+	ops      int
+	workers  int
+	readMix  float64
+	batch    int
+	compress bool
+	dict     bool
+	train    int
+	orgs     int64
+	seed     uint64
+}
+
+type phaseResult struct {
+	name     string
+	elapsed  time.Duration
+	reads    []time.Duration
+	writes   []time.Duration
+	recsRead int
+	recsWrit int
+}
+
+func (p *phaseResult) merge(o *phaseResult) {
+	p.reads = append(p.reads, o.reads...)
+	p.writes = append(p.writes, o.writes...)
+	p.recsRead += o.recsRead
+	p.recsWrit += o.recsWrit
+}
+
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(float64(len(sorted)-1) * p)
+	return sorted[i]
+}
+
+func (p *phaseResult) print() {
+	secs := p.elapsed.Seconds()
+	fmt.Printf("%s: %s, %.0f records/s\n", p.name, p.elapsed.Round(time.Millisecond),
+		float64(p.recsRead+p.recsWrit)/secs)
+
+	for _, l := range []struct {
+		name string
+		lat  []time.Duration
+		recs int
+	}{{"read", p.reads, p.recsRead}, {"write", p.writes, p.recsWrit}} {
+		if len(l.lat) == 0 {
+			continue
+		}
+		slices.Sort(l.lat)
+		fmt.Printf("  %-5s ops=%d records=%d ops/s=%.0f p50=%s p99=%s\n", l.name, len(l.lat), l.recs,
+			float64(len(l.lat))/secs, percentile(l.lat, 0.50), percentile(l.lat, 0.99))
+	}
+}
+
+func openCollection(db *sql.DB, cfg *config) (coll *sqlitekv.KeyVal[Record], err error) {
+	dictCol, err := sqlitekv.NewDictCollection(db)
+	if err != nil {
+		return
+	}
+
+	enc := sqlitekv.NewEncoder(dictCol)
+
+	coll, err = sqlitekv.NewKeyVal(db, "bench", sqlitekv.KeyValOptions[Record]{
+		Compression: cfg.compress,
+		UseDict:     cfg.dict,
+		Enc:         enc,
+		OnInsert:    func(r *Record) { r.Meta.Its = time.Now().Unix() },
+		OnUpdate:    func(r *Record) { r.Meta.Uts = time.Now().Unix() },
+		KeyField: &sqlitekv.KeyValField[Record]{
+			Name:   "id",
+			Type:   "INTEGER",
+			Get:    func(r *Record) any { return r.Id },
+			GetPtr: func(r *Record) any { return &r.Id },
+		},
+		Fields: []*sqlitekv.KeyValField[Record]{
+			{
+				Name:    "oid",
+				Type:    "INTEGER",
+				Indexed: true,
+				Get:     func(r *Record) any { return r.Oid },
+				GetPtr:  func(r *Record) any { return &r.Oid },
+			},
+		},
+	})
+	return
+}
+
+func write(coll *sqlitekv.KeyVal[Record], batch []*Record) error {
+	if len(batch) == 1 {
+		return coll.Upsert(batch[0])
+	}
+	return coll.UpsertBatch(batch)
+}
+
+// load writes records [0, cfg.records) split evenly across the workers.
+func load(name string, coll *sqlitekv.KeyVal[Record], cfg *config) (res *phaseResult, err error) {
+	res = &phaseResult{name: name}
+	results := make([]*phaseResult, cfg.workers)
+	errs := make([]error, cfg.workers)
+
+	var wg sync.WaitGroup
+	start := time.Now()
+	for w := range cfg.workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			r := &phaseResult{}
+			results[w] = r
+
+			gen, err := newGenerator(cfg.shape, cfg.size, cfg.orgs, cfg.seed+uint64(w))
+			if err != nil {
+				errs[w] = err
+				return
+			}
+
+			batch := make([]*Record, 0, cfg.batch)
+			for id := w; id < cfg.records; id += cfg.workers {
+				batch = append(batch, gen.record(int64(id)))
+				if len(batch) < cfg.batch && id+cfg.workers < cfg.records {
+					continue
+				}
+
+				t := time.Now()
+				err = write(coll, batch)
+				if err != nil {
+					errs[w] = err
+					return
+				}
+				r.writes = append(r.writes, time.Since(t))
+				r.recsWrit += len(batch)
+				batch = batch[:0]
+			}
+		}()
+	}
+	wg.Wait()
+	res.elapsed = time.Since(start)
+
+	for w := range cfg.workers {
+		if errs[w] != nil {
+			return nil, errs[w]
+		}
+		res.merge(results[w])
+	}
+	return
+}
+
+// mixed runs cfg.ops operations over the loaded key space. A write operation
+// upserts cfg.batch random records in one call.
+func mixed(coll *sqlitekv.KeyVal[Record], cfg *config) (res *phaseResult, err error) {
+	res = &phaseResult{name: "mixed"}
+	results := make([]*phaseResult, cfg.workers)
+	errs := make([]error, cfg.workers)
+
+	var wg sync.WaitGroup
+	start := time.Now()
+	for w := range cfg.workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			r := &phaseResult{}
+			results[w] = r
+
+			gen, err := newGenerator(cfg.shape, cfg.size, cfg.orgs, cfg.seed+uint64(cfg.workers+w))
+			if err != nil {
+				errs[w] = err
+				return
+			}
+			rnd := rand.New(rand.NewPCG(cfg.seed, uint64(w)))
+
+			for i := w; i < cfg.ops; i += cfg.workers {
+				if rnd.Float64() < cfg.readMix {
+					var rec Record
+					t := time.Now()
+					_, err = coll.Get(rnd.Int64N(int64(cfg.records)), &rec)
+					if err != nil {
+						errs[w] = err
+						return
+					}
+					r.reads = append(r.reads, time.Since(t))
+					r.recsRead++
+					continue
+				}
+
+				batch := make([]*Record, cfg.batch)
+				for j := range batch {
+					batch[j] = gen.record(rnd.Int64N(int64(cfg.records)))
+				}
+
+				t := time.Now()
+				err = write(coll, batch)
+				if err != nil {
+					errs[w] = err
+					return
+				}
+				r.writes = append(r.writes, time.Since(t))
+				r.recsWrit += len(batch)
+			}
+		}()
+	}
+	wg.Wait()
+	res.elapsed = time.Since(start)
+
+	for w := range cfg.workers {
+		if errs[w] != nil {
+			return nil, errs[w]
+		}
+		res.merge(results[w])
+	}
+	return
+}
+
+func printSize(db *sql.DB) (err error) {
+	var rows, valBytes, pages, free, pageSize int64
+	err = db.QueryRow("SELECT COUNT(*), COALESCE(SUM(length(val)), 0) FROM bench").Scan(&rows, &valBytes)
+	if err != nil {
+		return
+	}
+	err = db.QueryRow("PRAGMA page_count").Scan(&pages)
+	if err != nil {
+		return
+	}
+	err = db.QueryRow("PRAGMA freelist_count").Scan(&free)
+	if err != nil {
+		return
+	}
+	err = db.QueryRow("PRAGMA page_size").Scan(&pageSize)
+	if err != nil {
+		return
+	}
+
+	if rows == 0 {
+		return
+	}
+
+	// Pages used by the dictionary table are included in the on-disk size.
+	used := (pages - free) * pageSize
+	fmt.Printf("size: records=%d disk=%d bytes/record=%.1f val bytes/record=%.1f\n",
+		rows, used, float64(used)/float64(rows), float64(valBytes)/float64(rows))
+	return
+}
+
+func run(logger *slog.Logger, cfg *config) (err error) {
+	db, err := sql.Open("sqlite3", "file:"+cfg.dbPath+"?_journal_mode=WAL&_synchronous=NORMAL&_busy_timeout=10000&_txlock=immediate")
+	if err != nil {
+		return
+	}
+	defer db.Close()
+
+	coll, err := openCollection(db, cfg)
+	if err != nil {
+		return
+	}
+
+	fmt.Printf("shape=%s size=%d records=%d ops=%d workers=%d read=%.2f batch=%d compress=%v dict=%v\n",
+		cfg.shape, cfg.size, cfg.records, cfg.ops, cfg.workers, cfg.readMix, cfg.batch, cfg.compress, cfg.dict)
+
+	res, err := load("load", coll, cfg)
+	if err != nil {
+		return
+	}
+	res.print()
+
+	if cfg.dict {
+		// Records written before the dictionary existed are compressed without
+		// it, so train and then rewrite the whole key space.
+		t := time.Now()
+		var tr sqlitekv.TrainResult
+		tr, err = coll.TrainWithOptions(sqlitekv.TrainOptions{Strategy: sqlitekv.TrainRandom, Limit: cfg.train})
+		if err != nil {
+			return
+		}
+		logger.Info("Trained dictionary", "version", tr.Dict.Ver, "samples", tr.Samples,
+			"size", len(tr.Dict.Buf), "duration", time.Since(t).String())
+
+		res, err = load("reload", coll, cfg)
+		if err != nil {
+			return
+		}
+		res.print()
+	}
+
+	if cfg.ops > 0 {
+		res, err = mixed(coll, cfg)
+		if err != nil {
+			return
+		}
+		res.print()
+	}
+
+	_, err = db.Exec("PRAGMA wal_checkpoint(TRUNCATE)")
+	if err != nil {
+		return
+	}
+	return printSize(db)
+}
+
+func main() {
+	logger := slog.Default()
+
+	cfg := &config{}
+	flag.StringVar(&cfg.dbPath, "db", "", "database file (default: temporary file)")
+	flag.BoolVar(&cfg.keep, "keep", false, "keep the temporary database")
+	flag.StringVar(&cfg.shape, "shape", "user", "record shape: small, user or doc")
+	flag.IntVar(&cfg.size, "size", 0, "pad records with text up to this many bytes")
+	flag.IntVar(&cfg.records, "records", 100000, "number of records to load")
+	flag.IntVar(&cfg.ops, "ops", 100000, "number of operations in the mixed phase")
+	flag.IntVar(&cfg.workers, "workers", 4, "number of concurrent workers")
+	flag.Float64Var(&cfg.readMix, "read", 0.8, "fraction of mixed operations that are reads")
+	flag.IntVar(&cfg.batch, "batch", 1, "records per write")
+	flag.BoolVar(&cfg.compress, "compress", true, "compress values")
+	flag.BoolVar(&cfg.dict, "dict", false, "train and use a compression dictionary")
+	flag.IntVar(&cfg.train, "train", 1000, "number of samples to train the dictionary on")
+	flag.Int64Var(&cfg.orgs, "orgs", 10, "number of distinct oid values")
+	flag.Uint64Var(&cfg.seed, "seed", 1, "random seed")
+	flag.Parse()
+
+	if cfg.workers < 1 || cfg.batch < 1 || cfg.records < 1 || cfg.orgs < 1 {
+		logger.Error("workers, batch, records and orgs must be positive")
+		os.Exit(2)
+	}
+	if cfg.dict && !cfg.compress {
+		logger.Error("-dict requires -compress")
+		os.Exit(2)
+	}
+
+	if cfg.dbPath == "" {
+		dir, err := os.MkdirTemp("", "sqlitekv-bench")
+		if err != nil {
+			logger.Error("Failed to create temp dir", "error", err)
+			os.Exit(1)
+		}
+		cfg.dbPath = dir + "/bench.db"
+		if !cfg.keep {
+			defer os.RemoveAll(dir)
+		} else {
+			logger.Info("Database", "path", cfg.dbPath)
+		}
+	}
+
+	err := run(logger, cfg)
+	if err != nil {
+		logger.Error("Benchmark failed", "error", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPercentile(t *testing.T) {
+	lat := []time.Duration{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+	if p := percentile(lat, 0.5); p != 5 {
+		t.Errorf("p50 = %d", p)
+	}
+	if p := percentile(lat, 0.99); p != 9 {
+		t.Errorf("p99 = %d", p)
+	}
+	if p := percentile(nil, 0.5); p != 0 {
+		t.Errorf("p50 of nothing = %d", p)
+	}
+}
+
+func TestLoadAndMixed(t *testing.T) {
+	cfg := &config{
+		shape:    "small",
+		records:  50,
+		ops:      40,
+		workers:  3,
+		readMix:  0.5,
+		batch:    4,
+		compress: true,
+		orgs:     5,
+		seed:     1,
+	}
+
+	db, err := sql.Open("sqlite3", "file:"+filepath.Join(t.TempDir(), "bench.db")+"?_busy_timeout=10000&_txlock=immediate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	coll, err := openCollection(db, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := load("load", coll, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Workers write 17, 17 and 16 ids in batches of up to 4.
+	if res.recsWrit != 50 || len(res.writes) != 5+5+4 || len(res.reads) != 0 {
+		t.Errorf("load wrote %d records in %d batches", res.recsWrit, len(res.writes))
+	}
+
+	var n int
+	err = db.QueryRow("SELECT COUNT(*) FROM bench WHERE oid BETWEEN 1000 AND 1004").Scan(&n)
+	if err != nil || n != 50 {
+		t.Errorf("bench has %d rows, %v", n, err)
+	}
+
+	res, err = mixed(coll, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.reads)+len(res.writes) != 40 || res.recsRead != len(res.reads) || res.recsWrit != 4*len(res.writes) {
+		t.Errorf("mixed did %d reads and %d writes of %d records", len(res.reads), len(res.writes), res.recsWrit)
+	}
+}
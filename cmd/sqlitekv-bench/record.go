@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/brianvoe/gofakeit/v7"
+)
+
+type Meta struct {
+	Its int64 `json:"its"`
+	Uts int64 `json:"uts"`
+}
+
+type Record struct {
+	Meta    Meta     `json:"_m"`
+	Id      int64    `json:"id"`
+	Oid     int64    `json:"oid"`
+	Name    string   `json:"name,omitempty"`
+	Dob     string   `json:"dob,omitempty"`
+	Addr    string   `json:"addr,omitempty"`
+	Email   string   `json:"email,omitempty"`
+	Company string   `json:"company,omitempty"`
+	Score   float64  `json:"score,omitempty"`
+	Tags    []string `json:"tags,omitempty"`
+	Notes   string   `json:"notes,omitempty"`
+}
+
+// shapes generate the record body for a given id. Every shape fills Id and
+// Oid so that the indexed column is populated.
+var shapes = map[string]func(f *gofakeit.Faker, r *Record){
+	"small": func(f *gofakeit.Faker, r *Record) {
+		r.Score = f.Float64Range(0, 100)
+	},
+	"user": func(f *gofakeit.Faker, r *Record) {
+		r.Name = f.Name()
+		r.Dob = f.Date().Format("2006-01-02")
+		r.Addr = f.Address().Address
+		r.Email = f.Email()
+		r.Company = f.Company()
+	},
+	"doc": func(f *gofakeit.Faker, r *Record) {
+		r.Name = f.Name()
+		r.Email = f.Email()
+		r.Company = f.Company()
+		r.Score = f.Float64Range(0, 100)
+		for i := 0; i < 5; i++ {
+			r.Tags = append(r.Tags, f.HackerNoun())
+		}
+		r.Notes = f.Paragraph(2, 4, 12, " ")
+	},
+}
+
+type generator struct {
+	f     *gofakeit.Faker
+	shape func(f *gofakeit.Faker, r *Record)
+	size  int
+	orgs  int64
+}
+
+func newGenerator(shape string, size int, orgs int64, seed uint64) (*generator, error) {
+	fn, ok := shapes[shape]
+	if !ok {
+		return nil, fmt.Errorf("unknown shape: %s", shape)
+	}
+
+	return &generator{f: gofakeit.New(seed), shape: fn, size: size, orgs: orgs}, nil
+}
+
+func (g *generator) record(id int64) *Record {
+	r := &Record{Id: id, Oid: 1000 + id%g.orgs}
+	g.shape(g.f, r)
+
+	// Pad with sentences until the notes reach the requested size.
+	if len(r.Notes) < g.size {
+		var sb strings.Builder
+		sb.WriteString(r.Notes)
+		for sb.Len() < g.size {
+			sb.WriteString(g.f.Sentence(12))
+			sb.WriteByte(' ')
+		}
+		r.Notes = sb.String()[:g.size]
+	}
+	return r
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestGenerator(t *testing.T) {
+	_, err := newGenerator("huge", 0, 1, 1)
+	if err == nil {
+		t.Error("unknown shape accepted")
+	}
+
+	for shape := range shapes {
+		a, err := newGenerator(shape, 500, 3, 7)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := newGenerator(shape, 500, 3, 7)
+
+		for id := range int64(10) {
+			r := a.record(id)
+			if !reflect.DeepEqual(r, b.record(id)) {
+				t.Errorf("%s: record %d differs for the same seed", shape, id)
+			}
+			if r.Id != id || r.Oid < 1000 || r.Oid >= 1003 {
+				t.Errorf("%s: record %d has id %d, oid %d", shape, id, r.Id, r.Oid)
+			}
+			if len(r.Notes) < 500 {
+				t.Errorf("%s: notes are %d bytes", shape, len(r.Notes))
+			}
+		}
+	}
+}
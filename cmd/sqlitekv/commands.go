@@ -0,0 +1,451 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+
+	"github.com/sudeep9/sqlitekv"
+)
+
+var errVerifyFailed = errors.New("verification failed")
+
+type collection = sqlitekv.KeyVal[sqlitekv.Document]
+
+func (a *app) open(name string) (*collection, error) {
+	return sqlitekv.OpenCollection(a.db, a.enc, name)
+}
+
+// openReadOnly opens a collection for commands that only read, without
+// updating the catalog or the collection's derived tables.
+func (a *app) openReadOnly(name string) (*collection, error) {
+	return sqlitekv.OpenCollectionReadOnly(a.db, a.enc, name)
+}
+
+func (a *app) parseKey(coll *collection, s string) (any, error) {
+	return sqlitekv.Coerce(s, coll.Spec().Key.Type)
+}
+
+func parseFlags(fs *flag.FlagSet, args []string, npos int) (pos []string, err error) {
+	// Positional arguments come first so that flags may follow them.
+	if len(args) < npos {
+		return nil, fmt.Errorf("%s: expected %d argument(s)", fs.Name(), npos)
+	}
+
+	pos = args[:npos]
+	err = fs.Parse(args[npos:])
+	if err == nil && fs.NArg() > 0 {
+		pos = append(pos, fs.Args()...)
+	}
+	return
+}
+
+func writeJSON(w io.Writer, v any) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func cmdLs(a *app, args []string) (err error) {
+	specs, err := a.cat.List()
+	if err != nil {
+		return
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tROWS\tDELETED\tKEY\tFIELDS")
+	for _, spec := range specs {
+		var rows, deleted int64
+		err = a.db.QueryRow(fmt.Sprintf("SELECT COUNT(*), COALESCE(SUM(flags & 1), 0) FROM %s", spec.Name)).
+			Scan(&rows, &deleted)
+		if err != nil {
+			return
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%s\t%d\n", spec.Name, rows, deleted, spec.Key.Name, len(spec.Fields))
+	}
+	return tw.Flush()
+}
+
+func cmdGet(a *app, args []string) (err error) {
+	if len(args) != 2 {
+		return fmt.Errorf("get: expected <table> <key>")
+	}
+
+	coll, err := a.openReadOnly(args[0])
+	if err != nil {
+		return
+	}
+
+	key, err := a.parseKey(coll, args[1])
+	if err != nil {
+		return
+	}
+
+	var doc sqlitekv.Document
+	ok, err := coll.Get(key, &doc)
+	if err != nil {
+		return
+	}
+	if !ok {
+		return fmt.Errorf("key %s not found", args[1])
+	}
+
+	return writeJSON(os.Stdout, doc)
+}
+
+func cmdSelect(a *app, args []string) (err error) {
+	fs := flag.NewFlagSet("select", flag.ContinueOnError)
+	where := fs.String("where", "", "SQL condition")
+	order := fs.String("order", "", "SQL order by")
+	limit := fs.Int("limit", 0, "max rows")
+	pos, err := parseFlags(fs, args, 1)
+	if err != nil {
+		return
+	}
+
+	coll, err := a.openReadOnly(pos[0])
+	if err != nil {
+		return
+	}
+
+	list, err := coll.Select(nil, sqlitekv.SelectOptions[sqlitekv.Document]{
+		Where: *where,
+		Order: *order,
+		Limit: *limit,
+	})
+	if err != nil {
+		return
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	for _, doc := range list {
+		err = enc.Encode(doc)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// normalizeJSON replaces json.Number with int64 or float64 so that documents
+// encode as CBOR numbers.
+func normalizeJSON(v any) any {
+	switch v := v.(type) {
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return n
+		}
+		f, _ := v.Float64()
+		return f
+	case map[string]any:
+		for k, e := range v {
+			v[k] = normalizeJSON(e)
+		}
+	case []any:
+		for i, e := range v {
+			v[i] = normalizeJSON(e)
+		}
+	}
+	return v
+}
+
+func cmdPut(a *app, args []string) (err error) {
+	if len(args) < 1 || len(args) > 2 {
+		return fmt.Errorf("put: expected <table> [json|-]")
+	}
+
+	coll, err := a.open(args[0])
+	if err != nil {
+		return
+	}
+
+	var r io.Reader = os.Stdin
+	if len(args) == 2 && args[1] != "-" {
+		r = bytes.NewReader([]byte(args[1]))
+	}
+
+	dec := json.NewDecoder(r)
+	dec.UseNumber()
+
+	var doc sqlitekv.Document
+	err = dec.Decode(&doc)
+	if err != nil {
+		return
+	}
+	doc = normalizeJSON(doc).(sqlitekv.Document)
+
+	return coll.Upsert(&doc)
+}
+
+func cmdDelete(a *app, args []string) (err error) {
+	fs := flag.NewFlagSet("delete", flag.ContinueOnError)
+	soft := fs.Bool("soft", false, "soft delete")
+	pos, err := parseFlags(fs, args, 2)
+	if err != nil {
+		return
+	}
+
+	coll, err := a.open(pos[0])
+	if err != nil {
+		return
+	}
+
+	key, err := a.parseKey(coll, pos[1])
+	if err != nil {
+		return
+	}
+
+	var n int64
+	if *soft {
+		n, err = coll.SoftDelete(key)
+	} else {
+		n, err = coll.Delete(key)
+	}
+	if err != nil {
+		return
+	}
+
+	fmt.Printf("%d row(s) deleted\n", n)
+	return
+}
+
+func cmdRestore(a *app, args []string) (err error) {
+	if len(args) != 2 {
+		return fmt.Errorf("restore: expected <table> <key>")
+	}
+
+	coll, err := a.open(args[0])
+	if err != nil {
+		return
+	}
+
+	key, err := a.parseKey(coll, args[1])
+	if err != nil {
+		return
+	}
+
+	n, err := coll.Undelete(key)
+	if err != nil {
+		return
+	}
+
+	fmt.Printf("%d row(s) restored\n", n)
+	return
+}
+
+var strategies = map[string]sqlitekv.TrainStrategy{
+	"first":      sqlitekv.TrainFirst,
+	"random":     sqlitekv.TrainRandom,
+	"recent":     sqlitekv.TrainRecent,
+	"stratified": sqlitekv.TrainStratified,
+}
+
+func cmdTrain(a *app, args []string) (err error) {
+	fs := flag.NewFlagSet("train", flag.ContinueOnError)
+	limit := fs.Int("limit", 1000, "number of sample rows")
+	strategy := fs.String("strategy", "first", "first, random, recent or stratified")
+	field := fs.String("field", "", "column to stratify by")
+	dictSize := fs.Int("dict-size", sqlitekv.DefaultDictSize, "dictionary size in bytes")
+	minSamples := fs.Int("min-samples", 0, "minimum number of samples")
+	dryRun := fs.Bool("dry-run", false, "report the projected ratio without storing the dictionary")
+	pos, err := parseFlags(fs, args, 1)
+	if err != nil {
+		return
+	}
+
+	st, ok := strategies[*strategy]
+	if !ok {
+		return fmt.Errorf("unknown strategy: %s", *strategy)
+	}
+
+	open := a.open
+	if *dryRun {
+		open = a.openReadOnly
+	}
+	coll, err := open(pos[0])
+	if err != nil {
+		return
+	}
+
+	res, err := coll.TrainWithOptions(sqlitekv.TrainOptions{
+		Strategy:      st,
+		Limit:         *limit,
+		StratifyField: *field,
+		DictSize:      *dictSize,
+		MinSamples:    *minSamples,
+		DryRun:        *dryRun,
+	})
+	if err != nil {
+		return
+	}
+
+	if *dryRun {
+		fmt.Printf("samples=%d bytes=%d dict=%d ratio=%.2f plain_ratio=%.2f\n",
+			res.Samples, res.SampleBytes, len(res.Dict.Buf), res.Ratio, res.PlainRatio)
+		return
+	}
+
+	fmt.Printf("trained %s version %d from %d samples, dict=%d bytes\n",
+		coll.DictKey(), res.Dict.Ver, res.Samples, len(res.Dict.Buf))
+	return
+}
+
+func cmdDicts(a *app, args []string) (err error) {
+	rows, err := a.db.Query(`SELECT key, ver, length(dict) FROM comp_dict ORDER BY key, ver`)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "KEY\tVERSION\tSIZE")
+	for rows.Next() {
+		var key string
+		var ver, size int64
+		err = rows.Scan(&key, &ver, &size)
+		if err != nil {
+			return
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%d\n", key, ver, size)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return
+	}
+	return tw.Flush()
+}
+
+func cmdStats(a *app, args []string) (err error) {
+	names := args
+	if len(names) == 0 {
+		var specs []sqlitekv.CollectionSpec
+		specs, err = a.cat.List()
+		if err != nil {
+			return
+		}
+		for _, spec := range specs {
+			names = append(names, spec.Name)
+		}
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tROWS\tDELETED\tSTORED\tRAW\tRATIO")
+	for _, name := range names {
+		var coll *collection
+		coll, err = a.openReadOnly(name)
+		if err != nil {
+			return
+		}
+
+		var st sqlitekv.CollectionStats
+		st, err = coll.Stats(context.Background())
+		if err != nil {
+			return
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%d\t%.2f\n", name, st.Rows, st.Deleted, st.StoredBytes, st.RawBytes, st.Ratio)
+	}
+	return tw.Flush()
+}
+
+func cmdExport(a *app, args []string) (err error) {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	format := fs.String("format", "ndjson", "ndjson or cbor")
+	out := fs.String("o", "-", "output file")
+	pos, err := parseFlags(fs, args, 1)
+	if err != nil {
+		return
+	}
+
+	var ef sqlitekv.ExportFormat
+	switch *format {
+	case "ndjson":
+		ef = sqlitekv.ExportNDJSON
+	case "cbor":
+		ef = sqlitekv.ExportCBORSeq
+	default:
+		return fmt.Errorf("unknown format: %s", *format)
+	}
+
+	coll, err := a.openReadOnly(pos[0])
+	if err != nil {
+		return
+	}
+
+	w := os.Stdout
+	if *out != "-" {
+		w, err = os.Create(*out)
+		if err != nil {
+			return
+		}
+		defer w.Close()
+	}
+
+	n, err := coll.Export(w, ef)
+	if err != nil {
+		return
+	}
+
+	fmt.Fprintf(os.Stderr, "exported %d record(s)\n", n)
+	return
+}
+
+func cmdImport(a *app, args []string) (err error) {
+	if len(args) < 1 || len(args) > 2 {
+		return fmt.Errorf("import: expected <table> [file|-]")
+	}
+
+	coll, err := a.open(args[0])
+	if err != nil {
+		return
+	}
+
+	r := os.Stdin
+	if len(args) == 2 && args[1] != "-" {
+		r, err = os.Open(args[1])
+		if err != nil {
+			return
+		}
+		defer r.Close()
+	}
+
+	n, err := coll.Import(r)
+	if err != nil {
+		return
+	}
+
+	fmt.Fprintf(os.Stderr, "imported %d record(s)\n", n)
+	return
+}
+
+func cmdVerify(a *app, args []string) (err error) {
+	if len(args) != 1 {
+		return fmt.Errorf("verify: expected <table>")
+	}
+
+	coll, err := a.openReadOnly(args[0])
+	if err != nil {
+		return
+	}
+
+	report, err := coll.Verify(context.Background())
+	if err != nil {
+		return
+	}
+
+	err = writeJSON(os.Stdout, report)
+	if err != nil {
+		return
+	}
+
+	if !report.OK() {
+		return errVerifyFailed
+	}
+	return
+}
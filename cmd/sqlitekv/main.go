@@ -0,0 +1,162 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+
+	"github.com/sudeep9/sqlitekv"
+)
+
+type command struct {
+	usage string
+	run   func(app *app, args []string) error
+}
+
+var commands = map[string]command{
+	"ls":      {"ls", cmdLs},
+	"get":     {"get <table> <key>", cmdGet},
+	"select":  {"select <table> [-where sql] [-order sql] [-limit n]", cmdSelect},
+	"put":     {"put <table> [json|-]", cmdPut},
+	"delete":  {"delete <table> <key> [-soft]", cmdDelete},
+	"restore": {"restore <table> <key>", cmdRestore},
+	"train":   {"train <table> [-limit n] [-strategy s] [-field f] [-dict-size n] [-min-samples n] [-dry-run]", cmdTrain},
+	"dicts":   {"dicts", cmdDicts},
+	"stats":   {"stats [table]", cmdStats},
+	"export":  {"export <table> [-format ndjson|cbor] [-o file]", cmdExport},
+	"import":  {"import <table> [file|-]", cmdImport},
+	"verify":  {"verify <table>", cmdVerify},
+}
+
+type app struct {
+	db  *sql.DB
+	enc *sqlitekv.Encoder
+	cat *sqlitekv.Catalog
+}
+
+// keyFile is the JSON layout of the -keys file. Keys are base64 encoded.
+type keyFile struct {
+	Current uint16            `json:"current"`
+	Keys    map[string]string `json:"keys"`
+	Index   string            `json:"index"`
+}
+
+func loadKeys(path string) (p *sqlitekv.StaticKeyProvider, err error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return
+	}
+
+	var kf keyFile
+	err = json.Unmarshal(buf, &kf)
+	if err != nil {
+		return
+	}
+
+	p = &sqlitekv.StaticKeyProvider{Current: kf.Current, Keys: make(map[uint16][]byte)}
+	for id, key := range kf.Keys {
+		var n uint64
+		n, err = strconv.ParseUint(id, 10, 16)
+		if err != nil {
+			return
+		}
+
+		p.Keys[uint16(n)], err = base64.StdEncoding.DecodeString(key)
+		if err != nil {
+			return
+		}
+	}
+
+	if kf.Index != "" {
+		p.Index, err = base64.StdEncoding.DecodeString(kf.Index)
+	}
+	return
+}
+
+func openApp(dbPath string, keysPath string) (a *app, err error) {
+	// kv_decode and kv_extract are available in -where conditions.
+	funcs := sqlitekv.RegisterSQLFunctions("sqlitekv")
+	db, err := sql.Open("sqlitekv", dbPath)
+	if err != nil {
+		return
+	}
+
+	dictColl, err := sqlitekv.NewDictCollection(db)
+	if err != nil {
+		return
+	}
+
+	var encOpts sqlitekv.EncoderOptions
+	if keysPath != "" {
+		encOpts.Keys, err = loadKeys(keysPath)
+		if err != nil {
+			return
+		}
+	}
+
+	cat, err := sqlitekv.NewCatalog(db)
+	if err != nil {
+		return
+	}
+
+	a = &app{
+		db:  db,
+		enc: sqlitekv.NewEncoderWithOptions(dictColl, encOpts),
+		cat: cat,
+	}
+	funcs.SetEncoder(a.enc)
+	return
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: sqlitekv [-db path] [-keys file] <command> [args]")
+	fmt.Fprintln(os.Stderr, "commands:")
+
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintln(os.Stderr, "  "+commands[name].usage)
+	}
+	flag.PrintDefaults()
+}
+
+func main() {
+	dbPath := flag.String("db", "sqlitekv.db", "database file")
+	keysPath := flag.String("keys", "", "JSON file with encryption keys")
+	flag.Usage = usage
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		usage()
+		os.Exit(2)
+	}
+
+	cmd, ok := commands[flag.Arg(0)]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command: %s\n", flag.Arg(0))
+		usage()
+		os.Exit(2)
+	}
+
+	a, err := openApp(*dbPath, *keysPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		os.Exit(1)
+	}
+	defer a.db.Close()
+
+	err = cmd.run(a, flag.Args()[1:])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		a.db.Close()
+		os.Exit(1)
+	}
+}
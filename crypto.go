@@ -0,0 +1,269 @@
+package sqlitekv
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"sync"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+const (
+	EncodeFlagEncrypt = 0x8
+
+	// The id of the key a value was encrypted with occupies bits 40-55.
+	KeyIDMask  = 0xffff0000000000
+	KeyIDShift = 40
+)
+
+// KeyProvider supplies AES-256 keys for encryption at rest. Key ids are
+// stored with every encrypted value, so a key must stay available under its
+// id for as long as any value references it.
+type KeyProvider interface {
+	CurrentKey() (id uint16, key []byte, err error)
+	Key(id uint16) (key []byte, err error)
+}
+
+type StaticKeyProvider struct {
+	Current uint16
+	Keys    map[uint16][]byte
+	Index   []byte
+}
+
+func (p *StaticKeyProvider) CurrentKey() (id uint16, key []byte, err error) {
+	key, err = p.Key(p.Current)
+	id = p.Current
+	return
+}
+
+func (p *StaticKeyProvider) Key(id uint16) (key []byte, err error) {
+	key, ok := p.Keys[id]
+	if !ok {
+		err = fmt.Errorf("unknown encryption key id: %d", id)
+	}
+	return
+}
+
+func IsEncrypted(flags int64) bool {
+	return flags&EncodeFlagEncrypt != 0
+}
+
+func KeyIDFromFlags(flags int64) uint16 {
+	return uint16((flags & KeyIDMask) >> KeyIDShift)
+}
+
+// AssocData binds an encrypted value to the row it is stored in, so that
+// ciphertext copied to another row or table fails to decrypt.
+func AssocData(table string, pkey any) ([]byte, error) {
+	return cbor.Marshal([]any{table, pkey})
+}
+
+type aeadCache struct {
+	mu    sync.RWMutex
+	aeads map[string]cipher.AEAD
+}
+
+func (c *aeadCache) get(key []byte) (aead cipher.AEAD, err error) {
+	c.mu.RLock()
+	aead, ok := c.aeads[string(key)]
+	c.mu.RUnlock()
+	if ok {
+		return
+	}
+
+	if len(key) != 32 {
+		err = fmt.Errorf("encryption key must be 32 bytes, got %d", len(key))
+		return
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return
+	}
+
+	aead, err = cipher.NewGCM(block)
+	if err != nil {
+		return
+	}
+
+	c.mu.Lock()
+	if c.aeads == nil {
+		c.aeads = make(map[string]cipher.AEAD)
+	}
+	c.aeads[string(key)] = aead
+	c.mu.Unlock()
+	return
+}
+
+func (e *Encoder) encrypt(flags int64, src []byte, ad []byte) (_ int64, dst []byte, err error) {
+	if e.keys == nil {
+		err = fmt.Errorf("encoder has no key provider for encryption")
+		return
+	}
+
+	id, key, err := e.keys.CurrentKey()
+	if err != nil {
+		return
+	}
+
+	aead, err := e.aeads.get(key)
+	if err != nil {
+		return
+	}
+
+	dst = make([]byte, aead.NonceSize(), aead.NonceSize()+len(src)+aead.Overhead())
+	_, err = rand.Read(dst)
+	if err != nil {
+		return
+	}
+
+	dst = aead.Seal(dst, dst, src, ad)
+	flags |= EncodeFlagEncrypt
+	flags |= int64(id) << KeyIDShift
+	return flags, dst, nil
+}
+
+func (e *Encoder) decrypt(src []byte, flags int64, ad []byte) (dst []byte, err error) {
+	if e.keys == nil {
+		err = fmt.Errorf("encoder has no key provider for decryption")
+		return
+	}
+
+	id := KeyIDFromFlags(flags)
+	key, err := e.keys.Key(id)
+	if err != nil {
+		return
+	}
+
+	aead, err := e.aeads.get(key)
+	if err != nil {
+		return
+	}
+
+	if len(src) < aead.NonceSize() {
+		err = fmt.Errorf("encrypted value too short")
+		return
+	}
+
+	nonce, ciphertext := src[:aead.NonceSize()], src[aead.NonceSize():]
+	dst, err = aead.Open(nil, nonce, ciphertext, ad)
+	if err != nil {
+		err = fmt.Errorf("failed to decrypt value with key id %d: %w", id, err)
+	}
+	return
+}
+
+// reencrypt replaces the encryption layer of src with one under the current
+// key, leaving the compressed payload and the dictionary bits untouched.
+func (e *Encoder) reencrypt(src []byte, flags int64, ad []byte) (_ int64, dst []byte, err error) {
+	checksum := HasChecksum(flags)
+	if checksum {
+		src, err = verifyChecksum(src, nil)
+		if err != nil {
+			return
+		}
+	}
+
+	payload := src
+	if IsEncrypted(flags) {
+		payload, err = e.decrypt(src, flags, ad)
+		if err != nil {
+			return
+		}
+	}
+
+	flags &^= EncodeFlagEncrypt | KeyIDMask | EncodeFlagChecksum
+	flags, dst, err = e.encrypt(flags, payload, ad)
+	if err != nil || !checksum {
+		return flags, dst, err
+	}
+
+	flags, dst = addChecksum(flags, dst)
+	return flags, dst, nil
+}
+
+// IndexKeyProvider is implemented by key providers that also supply the
+// HMAC key for blind indexes. The index key cannot be rotated without
+// rewriting every blind index column.
+type IndexKeyProvider interface {
+	IndexKey() (key []byte, err error)
+}
+
+func (p *StaticKeyProvider) IndexKey() (key []byte, err error) {
+	if len(p.Index) == 0 {
+		err = fmt.Errorf("no blind index key configured")
+	}
+	key = p.Index
+	return
+}
+
+// encryptField seals a single column value. The key id is prefixed to the
+// ciphertext since columns have no flags of their own.
+func (e *Encoder) encryptField(v any, ad []byte) (dst []byte, err error) {
+	buf, err := cbor.Marshal(v)
+	if err != nil {
+		return
+	}
+
+	flags, sealed, err := e.encrypt(0, buf, ad)
+	if err != nil {
+		return
+	}
+
+	dst = binary.BigEndian.AppendUint16(make([]byte, 0, 2+len(sealed)), KeyIDFromFlags(flags))
+	dst = append(dst, sealed...)
+	return
+}
+
+func (e *Encoder) decryptField(src []byte, ad []byte) (buf []byte, err error) {
+	if len(src) < 2 {
+		err = fmt.Errorf("encrypted field too short")
+		return
+	}
+
+	flags := EncodeFlagEncrypt | int64(binary.BigEndian.Uint16(src))<<KeyIDShift
+	return e.decrypt(src[2:], flags, ad)
+}
+
+func (e *Encoder) reencryptField(src []byte, ad []byte) (dst []byte, err error) {
+	buf, err := e.decryptField(src, ad)
+	if err != nil {
+		return
+	}
+
+	var v any
+	err = cbor.Unmarshal(buf, &v)
+	if err != nil {
+		return
+	}
+
+	return e.encryptField(v, ad)
+}
+
+func (e *Encoder) blindIndex(table, field string, v any) (sum []byte, err error) {
+	ikp, ok := e.keys.(IndexKeyProvider)
+	if !ok {
+		err = fmt.Errorf("key provider does not supply a blind index key")
+		return
+	}
+
+	key, err := ikp.IndexKey()
+	if err != nil {
+		return
+	}
+
+	msg, err := cbor.Marshal([]any{table, field, v})
+	if err != nil {
+		return
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write(msg)
+	sum = mac.Sum(nil)
+	return
+}
@@ -0,0 +1,80 @@
+package sqlitekv
+
+import (
+	"bytes"
+	"testing"
+)
+
+func openEncryptedUsers(t *testing.T, opts KeyValOptions[testUser]) *KeyVal[testUser] {
+	t.Helper()
+	db := openTestDB(t)
+	opts.KeyField = userKeyField()
+	opts.Enc = testEncoder(t, db, EncoderOptions{Keys: testKeys()})
+	opts.Encrypt = true
+	kv, err := NewKeyVal(db, "users", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return kv
+}
+
+func TestEncryptRoundTrip(t *testing.T) {
+	kv := openEncryptedUsers(t, KeyValOptions[testUser]{Compression: true})
+	for _, u := range []*testUser{{Id: 1, Name: "alice"}, {Id: 2, Name: "bob"}} {
+		err := kv.Upsert(u)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var val []byte
+	var flags int64
+	err := kv.db.QueryRow("SELECT flags, val FROM users WHERE id = 1").Scan(&flags, &val)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsEncrypted(flags) || bytes.Contains(val, []byte("alice")) {
+		t.Errorf("value is not encrypted: flags %x", flags)
+	}
+
+	var u testUser
+	ok, err := kv.Get(1, &u)
+	if err != nil || !ok || u.Name != "alice" {
+		t.Errorf("Get = %+v, %v, %v", u, ok, err)
+	}
+}
+
+func TestEncryptedValueBoundToRow(t *testing.T) {
+	kv := openEncryptedUsers(t, KeyValOptions[testUser]{})
+	for _, u := range []*testUser{{Id: 1, Name: "alice"}, {Id: 2, Name: "bob"}} {
+		err := kv.Upsert(u)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, err := kv.db.Exec("UPDATE users SET val = (SELECT val FROM users WHERE id = 2) WHERE id = 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var u testUser
+	_, err = kv.Get(1, &u)
+	if err == nil {
+		t.Fatalf("moved ciphertext decrypted as %+v", u)
+	}
+}
+
+func TestEncryptedFieldsNeedEncrypt(t *testing.T) {
+	db := openTestDB(t)
+	email := emailField()
+	email.BlindIndex = true
+	_, err := NewKeyVal(db, "users", KeyValOptions[testUser]{
+		KeyField: userKeyField(),
+		Fields:   []*KeyValField[testUser]{email},
+		Enc:      testEncoder(t, db, EncoderOptions{Keys: testKeys()}),
+	})
+	if err == nil {
+		t.Error("blind index without Encrypt was accepted")
+	}
+}
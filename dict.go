@@ -2,11 +2,27 @@ package sqlitekv
 
 import (
 	"database/sql"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/valyala/gozstd"
+)
+
+const (
+	sharedDictPrefix = "shared:"
+	zstdDictMagic    = 0xEC30A437
 )
 
+// SharedDictKey namespaces a dictionary key shared by several collections so
+// that it can never collide with the per-table keys, which are bare table
+// names.
+func SharedDictKey(name string) string {
+	return sharedDictPrefix + name
+}
+
 type Dict struct {
 	Buf []byte
-	Ver uint8
+	Ver uint32
 }
 
 type DictCollection struct {
@@ -40,7 +56,45 @@ func (c *DictCollection) Insert(key string, d Dict) (err error) {
 	return
 }
 
-func (c *DictCollection) Get(key string, ver uint8) (ok bool, dict Dict, err error) {
+// Add stores buf under the next free version of key. Versions are allocated
+// in the same statement as the insert, so concurrent writers sharing a key
+// never overwrite each other's dictionaries.
+func (c *DictCollection) Add(key string, buf []byte) (d Dict, err error) {
+	row := c.db.QueryRow(`INSERT INTO comp_dict (key, ver, dict)
+		SELECT ?, COALESCE(MAX(ver), 0) + 1, ? FROM comp_dict WHERE key = ?
+		HAVING COALESCE(MAX(ver), 0) < ?
+		RETURNING ver`, key, buf, key, MaxDictVer)
+	err = row.Scan(&d.Ver)
+	if err == sql.ErrNoRows {
+		err = fmt.Errorf("dictionary versions exhausted for key: %s", key)
+		return
+	}
+	if err != nil {
+		return
+	}
+
+	d.Buf = buf
+	return
+}
+
+// Import adds an externally built zstd dictionary as the next version of key.
+func (c *DictCollection) Import(key string, buf []byte) (d Dict, err error) {
+	if len(buf) < 8 || binary.LittleEndian.Uint32(buf) != zstdDictMagic {
+		err = fmt.Errorf("invalid zstd dictionary for key: %s: bad magic number", key)
+		return
+	}
+
+	ddict, err := gozstd.NewDDict(buf)
+	if err != nil {
+		err = fmt.Errorf("invalid zstd dictionary for key: %s: %w", key, err)
+		return
+	}
+	ddict.Release()
+
+	return c.Add(key, buf)
+}
+
+func (c *DictCollection) Get(key string, ver uint32) (ok bool, dict Dict, err error) {
 	row := c.db.QueryRow(`SELECT ver, dict FROM comp_dict WHERE key = ? AND ver = ?`, key, ver)
 	err = row.Scan(&dict.Ver, &dict.Buf)
 	if err == nil {
@@ -54,7 +108,27 @@ func (c *DictCollection) Get(key string, ver uint8) (ok bool, dict Dict, err err
 	return
 }
 
-func (c *DictCollection) GetMaxVersion(key string) (maxVer uint8, err error) {
+func (c *DictCollection) GetAll(key string) (dicts []Dict, err error) {
+	rows, err := c.db.Query(`SELECT ver, dict FROM comp_dict WHERE key = ? ORDER BY ver`, key)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var d Dict
+		err = rows.Scan(&d.Ver, &d.Buf)
+		if err != nil {
+			return
+		}
+		dicts = append(dicts, d)
+	}
+
+	err = rows.Err()
+	return
+}
+
+func (c *DictCollection) GetMaxVersion(key string) (maxVer uint32, err error) {
 	var n *int64
 	row := c.db.QueryRow(`SELECT MAX(ver) FROM comp_dict WHERE key = ?`, key)
 	err = row.Scan(&n)
@@ -63,7 +137,7 @@ func (c *DictCollection) GetMaxVersion(key string) (maxVer uint8, err error) {
 		return
 	}
 	if n != nil {
-		maxVer = uint8(*n)
+		maxVer = uint32(*n)
 	}
 	return
 }
@@ -85,7 +159,7 @@ func (c *DictCollection) GetLatest(key string) (ok bool, d Dict, err error) {
 	return
 }
 
-func (c *DictCollection) DeleteDict(key string, ver int64) (err error) {
+func (c *DictCollection) DeleteDict(key string, ver uint32) (err error) {
 	_, err = c.db.Exec(`DELETE FROM comp_dict WHERE key = ? AND ver = ?`, key, ver)
 	return
 }
@@ -0,0 +1,71 @@
+package sqlitekv
+
+import (
+	"database/sql"
+	"testing"
+)
+
+func openDictUsers(t *testing.T, db *sql.DB, enc *Encoder, name, dictKey string) *KeyVal[testUser] {
+	t.Helper()
+	kv, err := NewKeyVal(db, name, KeyValOptions[testUser]{
+		KeyField:    userKeyField(),
+		Enc:         enc,
+		Compression: true,
+		UseDict:     true,
+		DictKey:     dictKey,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return kv
+}
+
+func TestSharedDictKey(t *testing.T) {
+	db := openTestDB(t)
+	enc := testEncoder(t, db, EncoderOptions{})
+	users := openDictUsers(t, db, enc, "users", "")
+	orders := openDictUsers(t, db, enc, "orders", "users")
+	if users.DictKey() == orders.DictKey() || orders.DictKey() != SharedDictKey("users") {
+		t.Fatalf("dict keys %q and %q", users.DictKey(), orders.DictKey())
+	}
+
+	_, err := enc.DictCollection().Import(orders.DictKey(), []byte("not a dictionary"))
+	if err == nil {
+		t.Error("imported an invalid dictionary")
+	}
+
+	d, err := enc.DictCollection().Import(orders.DictKey(), testDict(t))
+	if err != nil || d.Ver != 1 {
+		t.Fatalf("Import = %d, %v", d.Ver, err)
+	}
+
+	// A collection opened later picks the dictionary up; one already open
+	// needs UseLatestDict.
+	returns := openDictUsers(t, db, enc, "returns", "users")
+	err = orders.UseLatestDict()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, kv := range []*KeyVal[testUser]{users, orders, returns} {
+		err = kv.Upsert(&testUser{Id: 1, Name: "user 1", Email: "user1@example.com"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var flags int64
+		err = db.QueryRow("SELECT flags FROM " + kv.Table().Name + " WHERE id = 1").Scan(&flags)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if shared := kv != users; IsDictCompressed(flags) != shared {
+			t.Errorf("%s: flags %x", kv.Table().Name, flags)
+		}
+
+		var u testUser
+		ok, err := kv.Get(1, &u)
+		if err != nil || !ok || u.Name != "user 1" {
+			t.Errorf("%s: Get = %+v, %v, %v", kv.Table().Name, u, ok, err)
+		}
+	}
+}
@@ -0,0 +1,240 @@
+package sqlitekv
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/valyala/gozstd"
+)
+
+type ZstdDict struct {
+	CDict *gozstd.CDict
+	DDict *gozstd.DDict
+}
+
+func (z *ZstdDict) release() {
+	if z.CDict != nil {
+		z.CDict.Release()
+	}
+	if z.DDict != nil {
+		z.DDict.Release()
+	}
+}
+
+// DictStoreOptions bounds the number of cached dictionaries and the bytes
+// they hold. Zero means unbounded.
+type DictStoreOptions struct {
+	MaxEntries int
+	MaxBytes   int64
+}
+
+type DictStoreStats struct {
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+	Entries   int
+	Bytes     int64
+}
+
+type dictID struct {
+	key string
+	ver uint32
+}
+
+// dictEntry holds the raw dictionary and builds its compression and
+// decompression halves on first use. Each half is built once, outside the
+// store lock; concurrent users of the same half wait for that build.
+type dictEntry struct {
+	id      dictID
+	buf     []byte
+	zdict   ZstdDict
+	cOnce   sync.Once
+	cErr    error
+	dOnce   sync.Once
+	dErr    error
+	size    int64
+	refs    int
+	evicted bool
+	elem    *list.Element
+}
+
+type dictLoad struct {
+	wg  sync.WaitGroup
+	err error
+}
+
+// DictStore is an LRU cache of native zstd dictionaries. Entries are
+// reference counted while in use by the Encoder, so an evicted dictionary is
+// released only after its last user is done with it.
+type DictStore struct {
+	mu    sync.Mutex
+	opts  DictStoreOptions
+	dicts map[dictID]*dictEntry
+	loads map[dictID]*dictLoad
+	lru   *list.List
+	stats DictStoreStats
+}
+
+func newDictStore(opts DictStoreOptions) (s *DictStore) {
+	s = &DictStore{
+		opts:  opts,
+		dicts: make(map[dictID]*dictEntry),
+		loads: make(map[dictID]*dictLoad),
+		lru:   list.New(),
+	}
+	return
+}
+
+// get returns the acquired entry for key and ver. On a miss the dictionary
+// is fetched once, however many goroutines are asking for it.
+func (s *DictStore) get(key string, ver uint32, fetch func() ([]byte, error)) (e *dictEntry, err error) {
+	id := dictID{key, ver}
+	for {
+		s.mu.Lock()
+		if e, ok := s.dicts[id]; ok {
+			s.stats.Hits++
+			e.refs++
+			s.lru.MoveToFront(e.elem)
+			s.mu.Unlock()
+			return e, nil
+		}
+
+		if l, ok := s.loads[id]; ok {
+			s.mu.Unlock()
+			l.wg.Wait()
+			if l.err != nil {
+				return nil, l.err
+			}
+			continue
+		}
+
+		s.stats.Misses++
+		l := &dictLoad{}
+		l.wg.Add(1)
+		s.loads[id] = l
+		s.mu.Unlock()
+
+		buf, err := fetch()
+
+		s.mu.Lock()
+		delete(s.loads, id)
+		if err == nil {
+			e = s.insertLocked(id, buf)
+		}
+		s.mu.Unlock()
+
+		l.err = err
+		l.wg.Done()
+		return e, err
+	}
+}
+
+func (s *DictStore) release(e *dictEntry) {
+	s.mu.Lock()
+	e.refs--
+	free := e.evicted && e.refs == 0
+	s.mu.Unlock()
+
+	if free {
+		e.zdict.release()
+	}
+}
+
+func (s *DictStore) SetDict(key string, ver uint32, buf []byte) (err error) {
+	s.mu.Lock()
+	e := s.insertLocked(dictID{key, ver}, buf)
+	s.mu.Unlock()
+
+	s.release(e)
+	return
+}
+
+// insertLocked returns the entry acquired, so that it cannot be freed by an
+// eviction before the caller uses it.
+func (s *DictStore) insertLocked(id dictID, buf []byte) (e *dictEntry) {
+	if e, ok := s.dicts[id]; ok {
+		e.refs++
+		s.lru.MoveToFront(e.elem)
+		return e
+	}
+
+	e = &dictEntry{
+		id:   id,
+		buf:  buf,
+		size: int64(len(buf)),
+		refs: 1,
+	}
+	e.elem = s.lru.PushFront(e)
+	s.dicts[id] = e
+	s.stats.Bytes += e.size
+
+	s.evict()
+	return
+}
+
+func (s *DictStore) cdict(e *dictEntry) (*gozstd.CDict, error) {
+	e.cOnce.Do(func() {
+		e.zdict.CDict, e.cErr = gozstd.NewCDict(e.buf)
+		if e.cErr == nil {
+			s.grow(e, int64(len(e.buf)))
+		}
+	})
+	return e.zdict.CDict, e.cErr
+}
+
+func (s *DictStore) ddict(e *dictEntry) (*gozstd.DDict, error) {
+	e.dOnce.Do(func() {
+		e.zdict.DDict, e.dErr = gozstd.NewDDict(e.buf)
+		if e.dErr == nil {
+			s.grow(e, int64(len(e.buf)))
+		}
+	})
+	return e.zdict.DDict, e.dErr
+}
+
+func (s *DictStore) grow(e *dictEntry, n int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if e.evicted {
+		return
+	}
+	e.size += n
+	s.stats.Bytes += n
+	s.evict()
+}
+
+func (s *DictStore) overLimit() bool {
+	if s.opts.MaxEntries > 0 && len(s.dicts) > s.opts.MaxEntries {
+		return true
+	}
+	if s.opts.MaxBytes > 0 && s.stats.Bytes > s.opts.MaxBytes {
+		return true
+	}
+	return false
+}
+
+func (s *DictStore) evict() {
+	// The front entry is the most recently used one; it stays even if it
+	// alone exceeds the limits.
+	for s.overLimit() && s.lru.Len() > 1 {
+		e := s.lru.Remove(s.lru.Back()).(*dictEntry)
+		delete(s.dicts, e.id)
+		s.stats.Bytes -= e.size
+		s.stats.Evictions++
+
+		e.evicted = true
+		if e.refs == 0 {
+			e.zdict.release()
+		}
+	}
+}
+
+func (s *DictStore) Stats() (stats DictStoreStats) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stats = s.stats
+	stats.Entries = len(s.dicts)
+	return
+}
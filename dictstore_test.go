@@ -0,0 +1,88 @@
+package sqlitekv
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPreloadAndEviction(t *testing.T) {
+	db := openTestDB(t)
+	enc := testEncoder(t, db, EncoderOptions{DictCache: DictStoreOptions{MaxEntries: 2}})
+	dict := testDict(t)
+	for range 3 {
+		_, err := enc.DictCollection().Add("users", dict)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := enc.Preload("users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats := enc.DictStats()
+	if stats.Entries != 2 || stats.Evictions != 1 || stats.Bytes <= 0 {
+		t.Errorf("after preload: %+v", stats)
+	}
+
+	obj := testUser{Id: 1, Name: "user 1"}
+	flags, buf, err := enc.Encode(&obj, EncodeOptions{Compress: true, UseDict: true, DictKey: "users", DictVer: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := enc.DictStats(); s.Hits != stats.Hits+1 || s.Misses != stats.Misses {
+		t.Errorf("latest version was not preloaded: %+v", s)
+	}
+
+	// Version 1 was evicted; using it loads it again.
+	flags, buf, err = enc.Encode(&obj, EncodeOptions{Compress: true, UseDict: true, DictKey: "users", DictVer: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got testUser
+	err = enc.Decode(buf, &got, flags, DecodeOptions{DictKey: "users"})
+	if err != nil || got != obj {
+		t.Errorf("Decode = %+v, %v", got, err)
+	}
+	if s := enc.DictStats(); s.Entries != 2 || s.Evictions < 2 {
+		t.Errorf("after reload: %+v", s)
+	}
+}
+
+func TestDictStoreLoadsOnce(t *testing.T) {
+	s := newDictStore(DictStoreOptions{})
+	dict := testDict(t)
+
+	var fetches atomic.Int32
+	fetch := func() ([]byte, error) {
+		fetches.Add(1)
+		time.Sleep(20 * time.Millisecond)
+		return dict, nil
+	}
+
+	var wg sync.WaitGroup
+	for range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			e, err := s.get("users", 1, fetch)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			_, err = s.ddict(e)
+			if err != nil {
+				t.Error(err)
+			}
+			s.release(e)
+		}()
+	}
+	wg.Wait()
+
+	stats := s.Stats()
+	if fetches.Load() != 1 || stats.Misses != 1 || stats.Hits != 19 || stats.Entries != 1 {
+		t.Errorf("fetches %d, stats %+v", fetches.Load(), stats)
+	}
+}
@@ -0,0 +1,261 @@
+package sqlitekv
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Document is an untyped value, e.g. an arbitrary JSON object.
+type Document = map[string]any
+
+// DocumentField declares a column whose value is extracted from the
+// document at Path, e.g. "address.city", and coerced to Type. Name defaults
+// to the path with dots replaced by underscores.
+type DocumentField struct {
+	Path       string
+	Name       string
+	Type       string
+	Unique     bool
+	Nullable   bool
+	Indexed    bool
+	Encrypted  bool
+	BlindIndex bool
+	FullText   bool
+	// Geo fields hold {"lat": .., "lon": ..} or [lat, lon].
+	Geo bool
+	// Vector fields hold an array of numbers.
+	VectorDims   int
+	VectorMetric VectorMetric
+}
+
+type DocumentOptions struct {
+	KeyField    DocumentField
+	Fields      []DocumentField
+	Enc         *Encoder
+	OnInsert    func(*Document)
+	OnUpdate    func(*Document)
+	Validate    func(*Document) error
+	Compression bool
+	UseDict     bool
+	DictKey     string
+	Encrypt     bool
+	Checksum    bool
+	JSONView    bool
+	PathIndexes []PathIndex
+	VectorIndex *VectorIndexOptions
+	ChangeLog   *ChangeLogOptions
+	KeepHistory bool
+	Audit       *AuditOptions
+}
+
+func (f DocumentField) spec() FieldSpec {
+	name := f.Name
+	if name == "" {
+		name = strings.ReplaceAll(f.Path, ".", "_")
+	}
+
+	return FieldSpec{
+		Name:         name,
+		Type:         f.Type,
+		Unique:       f.Unique,
+		Nullable:     f.Nullable,
+		Indexed:      f.Indexed,
+		Encrypted:    f.Encrypted,
+		BlindIndex:   f.BlindIndex,
+		FullText:     f.FullText,
+		Geo:          f.Geo,
+		VectorDims:   f.VectorDims,
+		VectorMetric: f.VectorMetric,
+		Path:         f.Path,
+	}
+}
+
+// NewDocumentCollection creates a collection of documents. Column values
+// are extracted from the declared paths on every write; a value that cannot
+// be coerced to its column type fails the write.
+func NewDocumentCollection(db *sql.DB, name string, opts DocumentOptions) (kv *KeyVal[Document], err error) {
+	if opts.KeyField.Path == "" && opts.KeyField.Name == "" {
+		err = fmt.Errorf("document key field must have a path")
+		return
+	}
+
+	kvOpts := KeyValOptions[Document]{
+		KeyField:    documentField(opts.KeyField.spec()),
+		Enc:         opts.Enc,
+		OnInsert:    opts.OnInsert,
+		OnUpdate:    opts.OnUpdate,
+		Compression: opts.Compression,
+		UseDict:     opts.UseDict,
+		DictKey:     opts.DictKey,
+		Encrypt:     opts.Encrypt,
+		Checksum:    opts.Checksum,
+		JSONView:    opts.JSONView,
+		PathIndexes: opts.PathIndexes,
+		VectorIndex: opts.VectorIndex,
+		ChangeLog:   opts.ChangeLog,
+		KeepHistory: opts.KeepHistory,
+		Audit:       opts.Audit,
+	}
+	for _, f := range opts.Fields {
+		kvOpts.Fields = append(kvOpts.Fields, documentField(f.spec()))
+	}
+
+	kvOpts.Validate = func(doc *Document) (err error) {
+		err = validateDocument(kvOpts, doc)
+		if err != nil {
+			return
+		}
+		if opts.Validate != nil {
+			err = opts.Validate(doc)
+		}
+		return
+	}
+
+	return NewKeyVal(db, name, kvOpts)
+}
+
+func validateDocument(opts KeyValOptions[Document], doc *Document) (err error) {
+	key := opts.KeyField
+	keyPath := fieldPath(key)
+	v, ok := DocumentPath(*doc, keyPath)
+	if !ok || v == nil {
+		return fmt.Errorf("document has no key at %s", keyPath)
+	}
+	_, err = Coerce(v, key.Type)
+	if err != nil {
+		return fmt.Errorf("key %s: %w", keyPath, err)
+	}
+
+	for _, f := range opts.Fields {
+		v, _ = DocumentPath(*doc, fieldPath(f))
+		switch {
+		case f.Geo:
+			if v != nil {
+				_, err = geoColumnValue(v)
+			}
+		case f.VectorDims > 0:
+			if v != nil {
+				_, err = vectorColumnValue(v, f.VectorDims)
+			}
+		default:
+			_, err = Coerce(v, f.Type)
+		}
+		if err != nil {
+			return fmt.Errorf("field %s: %w", fieldPath(f), err)
+		}
+	}
+	return
+}
+
+// fieldPath is the document path of f, which defaults to its column name.
+func fieldPath(f *KeyValField[Document]) string {
+	if f.Path == "" {
+		return f.Name
+	}
+	return f.Path
+}
+
+func documentField(spec FieldSpec) *KeyValField[Document] {
+	path := spec.Path
+	if path == "" {
+		path = spec.Name
+	}
+
+	return &KeyValField[Document]{
+		Name:         spec.Name,
+		Type:         spec.Type,
+		Unique:       spec.Unique,
+		Nullable:     spec.Nullable,
+		Indexed:      spec.Indexed,
+		Encrypted:    spec.Encrypted,
+		BlindIndex:   spec.BlindIndex,
+		FullText:     spec.FullText,
+		Geo:          spec.Geo,
+		VectorDims:   spec.VectorDims,
+		VectorMetric: spec.VectorMetric,
+		Path:         spec.Path,
+		Get: func(doc *Document) any {
+			v, _ := DocumentPath(*doc, path)
+			if spec.Geo || spec.VectorDims > 0 {
+				return v
+			}
+			c, err := Coerce(v, spec.Type)
+			if err != nil {
+				return v
+			}
+			return c
+		},
+		GetPtr: func(doc *Document) any {
+			return &pathScanner{doc: doc, path: path}
+		},
+	}
+}
+
+// pathScanner stores a scanned column at its path. Only the key has to be
+// in place before decoding, which replaces the whole document; NULLs are
+// skipped so that they don't create objects on the way to their path.
+type pathScanner struct {
+	doc  *Document
+	path string
+}
+
+func (s *pathScanner) Scan(v any) error {
+	if v == nil {
+		return nil
+	}
+	if *s.doc == nil {
+		*s.doc = make(Document)
+	}
+	return SetDocumentPath(*s.doc, s.path, v)
+}
+
+// DocumentPath returns the value at a dotted path. Numeric segments index
+// into arrays.
+func DocumentPath(doc Document, path string) (v any, ok bool) {
+	v = doc
+	for seg := range strings.SplitSeq(path, ".") {
+		switch c := v.(type) {
+		case map[string]any:
+			v, ok = c[seg]
+		case []any:
+			i, err := strconv.Atoi(seg)
+			ok = err == nil && i >= 0 && i < len(c)
+			if ok {
+				v = c[i]
+			}
+		default:
+			ok = false
+		}
+		if !ok {
+			return nil, false
+		}
+	}
+	return
+}
+
+// SetDocumentPath sets the value at a dotted path, creating intermediate
+// objects as needed.
+func SetDocumentPath(doc Document, path string, v any) error {
+	segs := strings.Split(path, ".")
+	m := doc
+	for _, seg := range segs[:len(segs)-1] {
+		next, ok := m[seg]
+		if !ok || next == nil {
+			child := make(map[string]any)
+			m[seg] = child
+			m = child
+			continue
+		}
+
+		child, ok := next.(map[string]any)
+		if !ok {
+			return fmt.Errorf("%s: %s is not an object", path, seg)
+		}
+		m = child
+	}
+
+	m[segs[len(segs)-1]] = v
+	return nil
+}
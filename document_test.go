@@ -0,0 +1,74 @@
+package sqlitekv
+
+import "testing"
+
+func TestOpenCollectionValidates(t *testing.T) {
+	db := openTestDB(t)
+	enc := testEncoder(t, db, EncoderOptions{})
+	_, err := NewDocumentCollection(db, "docs", DocumentOptions{
+		KeyField: DocumentField{Path: "id", Type: "TEXT"},
+		Fields:   []DocumentField{{Path: "age", Type: "INTEGER", Nullable: true}},
+		Enc:      enc,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kv, err := OpenCollection(db, enc, "docs")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, doc := range []Document{
+		{"name": "y"},
+		{"id": "a", "age": "notanumber"},
+	} {
+		if err := kv.Upsert(&doc); err == nil {
+			t.Errorf("Upsert(%v) succeeded", doc)
+		}
+	}
+
+	err = kv.Upsert(&Document{"id": "b", "age": "42"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var n int
+	err = db.QueryRow("SELECT COUNT(*) FROM docs").Scan(&n)
+	if err != nil || n != 1 {
+		t.Errorf("count = %d, %v", n, err)
+	}
+}
+
+func TestDocumentAbsentNestedPath(t *testing.T) {
+	db := openTestDB(t)
+	kv, err := NewDocumentCollection(db, "docs", DocumentOptions{
+		KeyField: DocumentField{Path: "id", Type: "TEXT"},
+		Fields:   []DocumentField{{Path: "address.city", Type: "TEXT", Nullable: true, Indexed: true}},
+		Enc:      testEncoder(t, db, EncoderOptions{}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = kv.Upsert(&Document{"id": "a", "name": "x"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	doc := Document{"stale": true}
+	ok, err := kv.Get("a", &doc)
+	if err != nil || !ok {
+		t.Fatalf("Get = %v, %v", ok, err)
+	}
+	if _, ok := doc["address"]; ok || doc["stale"] != nil || doc["name"] != "x" {
+		t.Errorf("Get = %v", doc)
+	}
+
+	list, err := kv.Select(nil, SelectOptions[Document]{})
+	if err != nil || len(list) != 1 {
+		t.Fatalf("Select = %v, %v", list, err)
+	}
+	if _, ok := (*list[0])["address"]; ok {
+		t.Errorf("Select = %v", *list[0])
+	}
+}
@@ -3,7 +3,6 @@ package sqlitekv
 import (
 	"database/sql"
 	"fmt"
-	"sync"
 
 	"github.com/fxamacker/cbor/v2"
 	"github.com/valyala/gozstd"
@@ -13,18 +12,32 @@ const (
 	EncodeSoftDelete   = 0x1
 	EncodeFlagCompress = 0x2
 	EncodeFlagUseDict  = 0x4
-	DictIDMask         = 0xff00
+
+	// The dictionary version occupies bits 8-39. Older rows stored it in
+	// bits 8-15 only, which is a prefix of the wider field, so they decode
+	// unchanged.
+	DictIDMask  = 0xffffffff00
+	DictIDShift = 8
+	MaxDictVer  = 0xffffffff
 )
 
 type EncodeOptions struct {
 	Compress bool
 	UseDict  bool
 	DictKey  string
-	DictVer  uint8
+	DictVer  uint32
+	Encrypt  bool
+	Checksum bool
+	// AssocData is authenticated along with the encrypted value, see
+	// AssocData.
+	AssocData []byte
 }
 
 type DecodeOptions struct {
-	DictKey string
+	DictKey   string
+	AssocData []byte
+	// PKey only names the row in errors.
+	PKey any
 }
 
 func IsCompressed(flags int64) bool {
@@ -35,104 +48,113 @@ func IsDictCompressed(flags int64) bool {
 	return flags&EncodeFlagUseDict != 0
 }
 
-type ZstdDict struct {
-	CDict *gozstd.CDict
-	DDict *gozstd.DDict
+func DictVerFromFlags(flags int64) uint32 {
+	return uint32((flags & DictIDMask) >> DictIDShift)
 }
 
-type DictStore struct {
-	rw    sync.RWMutex
-	dicts map[string]map[uint8]*ZstdDict
+type EncoderOptions struct {
+	DictCache DictStoreOptions
+	Keys      KeyProvider
 }
 
-func newDictStore() (s *DictStore) {
-	s = &DictStore{
-		dicts: make(map[string]map[uint8]*ZstdDict),
-	}
-	return
+type Encoder struct {
+	dictColl *DictCollection
+	store    *DictStore
+	keys     KeyProvider
+	aeads    aeadCache
 }
 
-func (s *DictStore) getZstdDict(key string, ver uint8) (zdict *ZstdDict) {
-	s.rw.RLock()
-	verMap, ok := s.dicts[key]
-	if !ok {
-		s.rw.RUnlock()
-		return
-	}
+func NewEncoder(dictColl *DictCollection) (e *Encoder) {
+	return NewEncoderWithOptions(dictColl, EncoderOptions{})
+}
 
-	zdict, ok = verMap[ver]
-	if ok {
-		s.rw.RUnlock()
-		return
+func NewEncoderWithOptions(dictColl *DictCollection, opts EncoderOptions) (e *Encoder) {
+	e = &Encoder{
+		dictColl: dictColl,
+		store:    newDictStore(opts.DictCache),
+		keys:     opts.Keys,
 	}
-
-	s.rw.RUnlock()
 	return
 }
 
-func (s *DictStore) GetCDict(key string, ver uint8) (cdict *gozstd.CDict) {
-	zdict := s.getZstdDict(key, ver)
-	if zdict == nil {
-		return nil
-	}
+func (e *Encoder) DictCollection() *DictCollection {
+	return e.dictColl
+}
 
-	return zdict.CDict
+func (e *Encoder) KeyProvider() KeyProvider {
+	return e.keys
 }
 
-func (s *DictStore) GetDDict(key string, ver uint8) (ddict *gozstd.DDict) {
-	zdict := s.getZstdDict(key, ver)
-	if zdict == nil {
-		return nil
-	}
+func (e *Encoder) DictStore() *DictStore {
+	return e.store
+}
 
-	return zdict.DDict
+func (e *Encoder) DictStats() DictStoreStats {
+	return e.store.Stats()
 }
 
-func (s *DictStore) SetDict(key string, ver uint8, buf []byte) (err error) {
-	s.rw.Lock()
-	cdict, err := gozstd.NewCDict(buf)
-	if err != nil {
-		s.rw.Unlock()
+// Preload loads every stored version of the given dictionary keys into the
+// cache, oldest first so the latest versions are the last to be evicted.
+// Decompression dictionaries are built for all versions and a compression
+// dictionary for the latest one.
+func (e *Encoder) Preload(keys ...string) (err error) {
+	if e.dictColl == nil {
+		err = fmt.Errorf("dictionary collection is not initialized")
 		return
 	}
 
-	ddict, err := gozstd.NewDDict(buf)
-	if err != nil {
-		s.rw.Unlock()
-		return
-	}
+	for _, key := range keys {
+		var dicts []Dict
+		dicts, err = e.dictColl.GetAll(key)
+		if err != nil {
+			return
+		}
 
-	zdict := &ZstdDict{
-		CDict: cdict,
-		DDict: ddict,
-	}
+		for i, d := range dicts {
+			err = e.store.SetDict(key, d.Ver, d.Buf)
+			if err != nil {
+				return
+			}
 
-	verMap, ok := s.dicts[key]
-	if !ok {
-		verMap = make(map[uint8]*ZstdDict)
-		s.dicts[key] = verMap
+			err = e.preloadHalves(key, d.Ver, i == len(dicts)-1)
+			if err != nil {
+				return
+			}
+		}
 	}
-	verMap[ver] = zdict
-	s.rw.Unlock()
-
 	return
 }
 
-type Encoder struct {
-	dictColl *DictCollection
-	store    *DictStore
-}
+func (e *Encoder) preloadHalves(key string, ver uint32, latest bool) (err error) {
+	entry, err := e.loadDict(key, ver)
+	if err != nil {
+		return
+	}
+	defer e.store.release(entry)
 
-func NewEncoder(dictColl *DictCollection) (e *Encoder) {
-	e = &Encoder{
-		dictColl: dictColl,
-		store:    newDictStore(),
+	_, err = e.store.ddict(entry)
+	if err != nil || !latest {
+		return
 	}
+
+	_, err = e.store.cdict(entry)
 	return
 }
 
-func (e *Encoder) DictCollection() *DictCollection {
-	return e.dictColl
+func (e *Encoder) loadDict(key string, ver uint32) (entry *dictEntry, err error) {
+	return e.store.get(key, ver, func() (buf []byte, err error) {
+		ok, d, err := e.dictColl.Get(key, ver)
+		if err != nil {
+			return
+		}
+		if !ok {
+			err = fmt.Errorf("no dictionary found for key: %s, ver=%d", key, ver)
+			return
+		}
+
+		buf = d.Buf
+		return
+	})
 }
 
 func (e *Encoder) Encode(obj any, opts EncodeOptions) (flags int64, ebuf []byte, err error) {
@@ -141,6 +163,25 @@ func (e *Encoder) Encode(obj any, opts EncodeOptions) (flags int64, ebuf []byte,
 		return
 	}
 
+	flags, ebuf, err = e.compress(buf, opts)
+	if err != nil {
+		return
+	}
+
+	if opts.Encrypt {
+		flags, ebuf, err = e.encrypt(flags, ebuf, opts.AssocData)
+		if err != nil {
+			return
+		}
+	}
+
+	if opts.Checksum {
+		flags, ebuf = addChecksum(flags, ebuf)
+	}
+	return
+}
+
+func (e *Encoder) compress(buf []byte, opts EncodeOptions) (flags int64, ebuf []byte, err error) {
 	if !opts.Compress {
 		ebuf = buf
 		return
@@ -157,28 +198,20 @@ func (e *Encoder) Encode(obj any, opts EncodeOptions) (flags int64, ebuf []byte,
 		return
 	}
 
-	cdict := e.store.GetCDict(opts.DictKey, opts.DictVer)
-	if cdict == nil {
-		ok, d, err := e.dictColl.Get(opts.DictKey, opts.DictVer)
-		if err != nil {
-			return 0, nil, err
-		}
-		if !ok {
-			err = fmt.Errorf("no dictionary found for key: %s, ver=%d", opts.DictKey, opts.DictVer)
-			return 0, nil, err
-		}
-
-		err = e.store.SetDict(opts.DictKey, opts.DictVer, d.Buf)
-		if err != nil {
-			return 0, nil, err
-		}
+	entry, err := e.loadDict(opts.DictKey, opts.DictVer)
+	if err != nil {
+		return
+	}
+	defer e.store.release(entry)
 
-		cdict = e.store.GetCDict(opts.DictKey, opts.DictVer)
+	cdict, err := e.store.cdict(entry)
+	if err != nil {
+		return
 	}
 
 	flags |= EncodeFlagCompress
 	flags |= EncodeFlagUseDict
-	ver := int64(opts.DictVer) << 8
+	ver := int64(opts.DictVer) << DictIDShift
 	flags = flags | ver
 	ebuf = gozstd.CompressDict(nil, buf, cdict)
 
@@ -186,6 +219,20 @@ func (e *Encoder) Encode(obj any, opts EncodeOptions) (flags int64, ebuf []byte,
 }
 
 func (e *Encoder) DecodeBuf(src []byte, flags int64, opts DecodeOptions) (buf []byte, err error) {
+	if HasChecksum(flags) {
+		src, err = verifyChecksum(src, opts.PKey)
+		if err != nil {
+			return
+		}
+	}
+
+	if IsEncrypted(flags) {
+		src, err = e.decrypt(src, flags, opts.AssocData)
+		if err != nil {
+			return
+		}
+	}
+
 	if !IsCompressed(flags) {
 		buf = src
 		return
@@ -201,30 +248,21 @@ func (e *Encoder) DecodeBuf(src []byte, flags int64, opts DecodeOptions) (buf []
 		return nil, err
 	}
 
-	dictVer := uint8((flags >> 8) & 0xFF)
+	dictVer := DictVerFromFlags(flags)
 	if opts.DictKey == "" {
 		err = fmt.Errorf("missing dict key for decoding")
 		return
 	}
 
-	ddict := e.store.GetDDict(opts.DictKey, dictVer)
-
-	if ddict == nil {
-		ok, d, err := e.dictColl.Get(opts.DictKey, dictVer)
-		if err != nil {
-			return nil, err
-		}
-		if !ok {
-			err = fmt.Errorf("no dictionary found for key: %s, ver=%d", opts.DictKey, dictVer)
-			return nil, err
-		}
-
-		err = e.store.SetDict(opts.DictKey, dictVer, d.Buf)
-		if err != nil {
-			return nil, err
-		}
+	entry, err := e.loadDict(opts.DictKey, dictVer)
+	if err != nil {
+		return
+	}
+	defer e.store.release(entry)
 
-		ddict = e.store.GetDDict(opts.DictKey, dictVer)
+	ddict, err := e.store.ddict(entry)
+	if err != nil {
+		return
 	}
 
 	buf, err = gozstd.DecompressDict(nil, src, ddict)
@@ -232,36 +270,86 @@ func (e *Encoder) DecodeBuf(src []byte, flags int64, opts DecodeOptions) (buf []
 }
 
 func (e *Encoder) Decode(src []byte, destObj any, flags int64, opts DecodeOptions) (err error) {
-	if !IsCompressed(flags) {
-		err = cbor.Unmarshal(src, destObj)
+	buf, err := e.DecodeBuf(src, flags, opts)
+	if err != nil {
 		return
 	}
+	return unmarshalValue(buf, destObj)
+}
 
-	buf, err := e.DecodeBuf(src, flags, opts)
-	if err != nil {
+// unmarshalValue decodes a CBOR value, with string-keyed maps for
+// Documents.
+func unmarshalValue(buf []byte, destObj any) error {
+	if _, ok := destObj.(*map[string]any); ok {
+		return untypedDecMode.Unmarshal(buf, destObj)
+	}
+	return cbor.Unmarshal(buf, destObj)
+}
+
+func (e *Encoder) TrainSamples(key string, samples [][]byte, opts TrainOptions) (res TrainResult, err error) {
+	dictSize := opts.DictSize
+	if dictSize <= 0 {
+		dictSize = DefaultDictSize
+	}
+
+	if len(samples) == 0 || len(samples) < opts.MinSamples {
+		err = fmt.Errorf("not enough samples to train dictionary for key: %s, got=%d, min=%d",
+			key, len(samples), opts.MinSamples)
+		return
+	}
+
+	res.Samples = len(samples)
+	res.Dict.Buf = gozstd.BuildDict(samples, dictSize)
+	if len(res.Dict.Buf) == 0 {
+		err = fmt.Errorf("failed to build dictionary for key: %s", key)
+		return
+	}
+
+	if opts.DryRun {
+		err = projectRatio(&res, samples)
 		return
 	}
 
-	err = cbor.Unmarshal(buf, destObj)
+	if e.dictColl == nil {
+		err = fmt.Errorf("dictionary collection is not initialized")
+		return
+	}
+
+	res.Dict, err = e.dictColl.Add(key, res.Dict.Buf)
 	return
 }
 
-func (e *Encoder) train(key string, samples [][]byte) (d Dict, err error) {
-	maxVer, err := e.dictColl.GetMaxVersion(key)
+func projectRatio(res *TrainResult, samples [][]byte) (err error) {
+	cdict, err := gozstd.NewCDict(res.Dict.Buf)
 	if err != nil {
 		return
 	}
+	defer cdict.Release()
+
+	var buf []byte
+	for _, sample := range samples {
+		res.SampleBytes += int64(len(sample))
+
+		buf = gozstd.CompressDict(buf[:0], sample, cdict)
+		res.CompressedBytes += int64(len(buf))
+
+		buf = gozstd.Compress(buf[:0], sample)
+		res.PlainCompressedBytes += int64(len(buf))
+	}
 
-	d.Ver = maxVer + 1
-	d.Buf = gozstd.BuildDict(samples, 112640)
-	err = e.dictColl.Insert(key, d)
+	if res.CompressedBytes > 0 {
+		res.Ratio = float64(res.SampleBytes) / float64(res.CompressedBytes)
+	}
+	if res.PlainCompressedBytes > 0 {
+		res.PlainRatio = float64(res.SampleBytes) / float64(res.PlainCompressedBytes)
+	}
 	return
 }
 
-func (e *Encoder) TrainWithRows(db *sql.DB, key string, selectSql string) (d Dict, err error) {
+func (e *Encoder) TrainWithRows(db *sql.DB, key string, selectSql string, opts TrainOptions) (res TrainResult, err error) {
 	rows, err := db.Query(selectSql)
 	if err != nil {
-		return d, err
+		return
 	}
 	defer rows.Close()
 
@@ -271,16 +359,22 @@ func (e *Encoder) TrainWithRows(db *sql.DB, key string, selectSql string) (d Dic
 		var val []byte
 		err = rows.Scan(&flags, &val)
 		if err != nil {
-			return d, err
+			return
 		}
 
-		buf, err := e.DecodeBuf(val, flags, DecodeOptions{DictKey: key})
+		var buf []byte
+		buf, err = e.DecodeBuf(val, flags, DecodeOptions{DictKey: key})
 		if err != nil {
-			return d, err
+			return
 		}
 
 		samples = append(samples, buf)
 	}
 
-	return e.train(key, samples)
+	err = rows.Err()
+	if err != nil {
+		return
+	}
+
+	return e.TrainSamples(key, samples, opts)
 }
@@ -0,0 +1,73 @@
+package sqlitekv
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/valyala/gozstd"
+)
+
+func testDict(t *testing.T) []byte {
+	t.Helper()
+	var samples [][]byte
+	for i := range 2000 {
+		buf, err := cbor.Marshal(testUser{Id: int64(i), Name: fmt.Sprintf("user %d", i%97),
+			Email: fmt.Sprintf("user%d@example.com", i)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		samples = append(samples, buf)
+	}
+	return gozstd.BuildDict(samples, 4096)
+}
+
+func TestDictVersionFlags(t *testing.T) {
+	db := openTestDB(t)
+	enc := testEncoder(t, db, EncoderOptions{})
+	dict := testDict(t)
+	for _, ver := range []uint32{3, 300, MaxDictVer} {
+		err := enc.DictCollection().Insert("users", Dict{Buf: dict, Ver: ver})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	obj := testUser{Id: 1, Name: "user 1", Email: "user1@example.com"}
+	for _, ver := range []uint32{3, 300, MaxDictVer} {
+		flags, buf, err := enc.Encode(&obj, EncodeOptions{Compress: true, UseDict: true, DictKey: "users", DictVer: ver})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := DictVerFromFlags(flags); got != ver {
+			t.Errorf("DictVerFromFlags = %d, want %d", got, ver)
+		}
+		if flags&^(DictIDMask|EncodeFlagCompress|EncodeFlagUseDict) != 0 {
+			t.Errorf("version %d: unexpected flags %x", ver, flags)
+		}
+
+		var got testUser
+		err = enc.Decode(buf, &got, flags, DecodeOptions{DictKey: "users"})
+		if err != nil || !reflect.DeepEqual(got, obj) {
+			t.Errorf("version %d: decoded %+v, %v", ver, got, err)
+		}
+	}
+
+	// Rows written before the version was widened kept it in bits 8-15 of
+	// the same field, with the soft-delete bit alongside.
+	flags, buf, err := enc.Encode(&obj, EncodeOptions{Compress: true, UseDict: true, DictKey: "users", DictVer: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacy := int64(EncodeSoftDelete | EncodeFlagCompress | EncodeFlagUseDict | 3<<8)
+	if flags|EncodeSoftDelete != legacy {
+		t.Fatalf("flags = %x, legacy = %x", flags, legacy)
+	}
+
+	var got testUser
+	err = enc.Decode(buf, &got, legacy, DecodeOptions{DictKey: "users"})
+	if err != nil || !reflect.DeepEqual(got, obj) {
+		t.Errorf("legacy: decoded %+v, %v", got, err)
+	}
+}
@@ -0,0 +1,235 @@
+package sqlitekv
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+type ExportFormat int
+
+const (
+	ExportNDJSON ExportFormat = iota
+	ExportCBORSeq
+)
+
+const importBatchSize = 500
+
+// ExportRecord is one line of an NDJSON export or one item of a CBOR
+// sequence. Flags are the stored encoding flags, kept for inspection only;
+// Import re-encodes values with the target collection's settings.
+type ExportRecord[T any] struct {
+	Key     any   `json:"key" cbor:"key"`
+	Deleted bool  `json:"deleted" cbor:"deleted"`
+	Flags   int64 `json:"flags" cbor:"flags"`
+	Value   *T    `json:"value" cbor:"value"`
+}
+
+type recordEncoder interface {
+	Encode(v any) error
+}
+
+// Export writes every row of the collection, soft-deleted ones included, in
+// rowid order.
+func (kv *KeyVal[T]) Export(w io.Writer, format ExportFormat) (n int64, err error) {
+	var enc recordEncoder
+	switch format {
+	case ExportNDJSON:
+		enc = json.NewEncoder(w)
+	case ExportCBORSeq:
+		enc = cbor.NewEncoder(w)
+	default:
+		err = fmt.Errorf("unknown export format: %d", format)
+		return
+	}
+
+	s := strings.Builder{}
+	s.WriteString("SELECT ")
+	s.WriteString(kv.opts.KeyField.Name)
+	s.WriteString(", flags, val FROM ")
+	s.WriteString(kv.tab.Name)
+	s.WriteString(" ORDER BY rowid")
+
+	rows, err := kv.db.Query(s.String())
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var buf []byte
+		rec := ExportRecord[T]{Value: new(T)}
+		err = rows.Scan(kv.opts.KeyField.GetPtr(rec.Value), &rec.Flags, &buf)
+		if err != nil {
+			return
+		}
+
+		err = kv.decode(buf, rec.Flags, rec.Value)
+		if err != nil {
+			return
+		}
+
+		rec.Key = kv.opts.KeyField.Get(rec.Value)
+		rec.Deleted = rec.Flags&EncodeSoftDelete != 0
+		err = enc.Encode(&rec)
+		if err != nil {
+			return
+		}
+		n++
+	}
+
+	err = rows.Err()
+	return
+}
+
+type recordDecoder interface {
+	Decode(v any) error
+}
+
+// Import reads an export in either format, detected from its first byte, and
+// upserts the records in batches. Hooks other than Validate are not run so
+// that imported objects are stored as exported.
+func (kv *KeyVal[T]) Import(r io.Reader) (n int64, err error) {
+	br := bufio.NewReader(r)
+	first, err := firstNonSpace(br)
+	if err == io.EOF {
+		err = nil
+		return
+	}
+	if err != nil {
+		return
+	}
+
+	var dec recordDecoder
+	if first == '{' {
+		jdec := json.NewDecoder(br)
+		jdec.UseNumber()
+		dec = jdec
+	} else {
+		dec = cbor.NewDecoder(br)
+	}
+
+	objs := make([]*T, 0, importBatchSize)
+	deleted := make([]bool, 0, importBatchSize)
+	flush := func() (err error) {
+		if len(objs) == 0 {
+			return
+		}
+
+		err = kv.upsertBatch(context.Background(), objs, deleted, false)
+		if err != nil {
+			return
+		}
+
+		n += int64(len(objs))
+		objs = objs[:0]
+		deleted = deleted[:0]
+		return
+	}
+
+	for {
+		var rec ExportRecord[T]
+		err = dec.Decode(&rec)
+		if err == io.EOF {
+			err = flush()
+			return
+		}
+		if err != nil {
+			err = fmt.Errorf("import record %d: %w", n+int64(len(objs))+1, err)
+			return
+		}
+
+		if rec.Value == nil {
+			err = fmt.Errorf("import record %d: missing value", n+int64(len(objs))+1)
+			return
+		}
+
+		if first == '{' {
+			normalizeNumbers(reflect.ValueOf(rec.Value))
+		}
+
+		objs = append(objs, rec.Value)
+		deleted = append(deleted, rec.Deleted)
+		if len(objs) == importBatchSize {
+			err = flush()
+			if err != nil {
+				return
+			}
+		}
+	}
+}
+
+// normalizeNumbers replaces the json.Number values that UseNumber leaves in
+// interfaces under v with int64 or float64, so that large integers keep
+// their precision.
+func normalizeNumbers(v reflect.Value) {
+	switch v.Kind() {
+	case reflect.Pointer:
+		if !v.IsNil() {
+			normalizeNumbers(v.Elem())
+		}
+	case reflect.Interface:
+		if v.IsNil() {
+			return
+		}
+		if n, ok := v.Interface().(json.Number); ok {
+			if v.CanSet() {
+				v.Set(reflect.ValueOf(jsonNumber(n)))
+			}
+			return
+		}
+		normalizeNumbers(v.Elem())
+	case reflect.Struct:
+		for i := range v.NumField() {
+			if v.Field(i).CanSet() {
+				normalizeNumbers(v.Field(i))
+			}
+		}
+	case reflect.Slice, reflect.Array:
+		for i := range v.Len() {
+			normalizeNumbers(v.Index(i))
+		}
+	case reflect.Map:
+		iter := v.MapRange()
+		for iter.Next() {
+			e := iter.Value()
+			if n, ok := e.Interface().(json.Number); ok && e.Kind() == reflect.Interface {
+				v.SetMapIndex(iter.Key(), reflect.ValueOf(jsonNumber(n)))
+				continue
+			}
+			normalizeNumbers(e)
+		}
+	}
+}
+
+func jsonNumber(n json.Number) any {
+	if i, err := n.Int64(); err == nil {
+		return i
+	}
+	f, _ := n.Float64()
+	return f
+}
+
+func firstNonSpace(br *bufio.Reader) (b byte, err error) {
+	for i := 1; ; i++ {
+		var buf []byte
+		buf, err = br.Peek(i)
+		if len(buf) < i {
+			if err == nil {
+				err = io.EOF
+			}
+			return
+		}
+
+		b = buf[i-1]
+		if b != ' ' && b != '\t' && b != '\n' && b != '\r' {
+			return b, nil
+		}
+	}
+}
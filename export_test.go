@@ -0,0 +1,57 @@
+package sqlitekv
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestImportKeepsLargeIntegers(t *testing.T) {
+	db := openTestDB(t)
+	enc := testEncoder(t, db, EncoderOptions{})
+	open := func(name string) *KeyVal[Document] {
+		kv, err := NewDocumentCollection(db, name, DocumentOptions{
+			KeyField: DocumentField{Path: "id", Type: "TEXT"},
+			Enc:      enc,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return kv
+	}
+
+	src := open("src")
+	err := src.Upsert(&Document{"id": "a", "n": int64(9007199254740993), "list": []any{int64(1), 2.5}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	_, err = src.Export(&buf, ExportNDJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dst := open("dst")
+	_, err = dst.Import(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var doc Document
+	ok, err := dst.Get("a", &doc)
+	if err != nil || !ok {
+		t.Fatal(ok, err)
+	}
+	// Documents decode CBOR integers as int64 or uint64; floats would have
+	// lost the last digit.
+	if _, isFloat := doc["n"].(float64); isFloat {
+		t.Fatalf("n decoded as float64")
+	}
+	if n, err := Coerce(doc["n"], "INTEGER"); err != nil || n != int64(9007199254740993) {
+		t.Errorf("n = %T %v", doc["n"], doc["n"])
+	}
+	list := doc["list"].([]any)
+	if _, isFloat := list[0].(float64); isFloat || list[1] != 2.5 {
+		t.Errorf("list = %#v", list)
+	}
+}
@@ -0,0 +1,252 @@
+package sqlitekv
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+type SearchOptions struct {
+	// Where is an extra condition on the collection's columns.
+	Where  string
+	Limit  int
+	Offset int
+	// Highlight and Snippet fill SearchResult.Highlights and Snippets,
+	// marking matches with HighlightStart and HighlightEnd ("<b>" and
+	// "</b>" by default).
+	Highlight      bool
+	Snippet        bool
+	HighlightStart string
+	HighlightEnd   string
+	// SnippetTokens is the maximum number of tokens per snippet, 16 by
+	// default.
+	SnippetTokens int
+}
+
+type SearchResult[T any] struct {
+	Obj  *T
+	Rank float64
+	// Highlights and Snippets are keyed by column name.
+	Highlights map[string]string
+	Snippets   map[string]string
+}
+
+func (kv *KeyVal[T]) FullTextTableName() string {
+	return kv.tab.Name + "_fts"
+}
+
+func (kv *KeyVal[T]) fullTextFields() (fields []*KeyValField[T]) {
+	for _, f := range kv.opts.Fields {
+		if f.FullText {
+			fields = append(fields, f)
+		}
+	}
+	return
+}
+
+func (kv *KeyVal[T]) fullTextSql() []string {
+	fts := kv.FullTextTableName()
+	fields := kv.fullTextFields()
+
+	cols := make([]string, len(fields))
+	oldCols := make([]string, len(fields))
+	newCols := make([]string, len(fields))
+	for i, f := range fields {
+		cols[i] = f.Name
+		oldCols[i] = "old." + f.Name
+		newCols[i] = "new." + f.Name
+	}
+	colList := strings.Join(cols, ", ")
+
+	insertNew := fmt.Sprintf("INSERT INTO %s(rowid, %s) SELECT new.rowid, %s WHERE new.flags & 1 = 0;",
+		fts, colList, strings.Join(newCols, ", "))
+	deleteOld := fmt.Sprintf("INSERT INTO %s(%s, rowid, %s) SELECT 'delete', old.rowid, %s WHERE old.flags & 1 = 0;",
+		fts, fts, colList, strings.Join(oldCols, ", "))
+
+	return []string{
+		fmt.Sprintf("CREATE VIRTUAL TABLE %s USING fts5(%s, content='%s', content_rowid='rowid')",
+			fts, colList, kv.tab.Name),
+		fmt.Sprintf("CREATE TRIGGER %s_ai AFTER INSERT ON %s BEGIN %s END", fts, kv.tab.Name, insertNew),
+		fmt.Sprintf("CREATE TRIGGER %s_ad AFTER DELETE ON %s BEGIN %s END", fts, kv.tab.Name, deleteOld),
+		fmt.Sprintf("CREATE TRIGGER %s_au AFTER UPDATE ON %s BEGIN %s %s END", fts, kv.tab.Name, deleteOld, insertNew),
+		fmt.Sprintf("INSERT INTO %s(rowid, %s) SELECT rowid, %s FROM %s WHERE flags & 1 = 0",
+			fts, colList, colList, kv.tab.Name),
+	}
+}
+
+// syncFullText creates the full-text table and its triggers, and rebuilds
+// them when the set of FullText columns changed.
+func (kv *KeyVal[T]) syncFullText() (err error) {
+	fts := kv.FullTextTableName()
+	stmts := kv.fullTextSql()
+	want := len(kv.fullTextFields()) > 0
+
+	var current string
+	err = kv.db.QueryRow(`SELECT sql FROM sqlite_master WHERE type = 'table' AND name = ?`, fts).Scan(&current)
+	if err != nil && err != sql.ErrNoRows {
+		return
+	}
+	exists := err == nil
+	err = nil
+
+	if exists && want && current == stmts[0] {
+		return
+	}
+
+	tx, err := kv.db.Begin()
+	if err != nil {
+		return
+	}
+	defer tx.Rollback()
+
+	if exists {
+		for _, s := range []string{"_ai", "_ad", "_au"} {
+			_, err = tx.Exec(fmt.Sprintf("DROP TRIGGER IF EXISTS %s%s", fts, s))
+			if err != nil {
+				return
+			}
+		}
+		_, err = tx.Exec(fmt.Sprintf("DROP TABLE %s", fts))
+		if err != nil {
+			return
+		}
+	}
+
+	if want {
+		for _, s := range stmts {
+			_, err = tx.Exec(s)
+			if err != nil {
+				return fmt.Errorf("full-text table %s: %w", fts, err)
+			}
+		}
+	}
+
+	return tx.Commit()
+}
+
+// Search runs an FTS5 query against the FullText columns and returns the
+// matching objects, best match first.
+//
+// The full-text table <table>_fts is an external-content FTS5 table kept in
+// sync by triggers. Soft-deleted rows are removed from it and added back
+// when undeleted. FTS5 needs go-sqlite3 built with the sqlite_fts5 tag.
+// Limit and Offset apply after Where.
+func (kv *KeyVal[T]) Search(query string, opts SearchOptions) (list []*SearchResult[T], err error) {
+	list = make([]*SearchResult[T], 0)
+
+	fields := kv.fullTextFields()
+	if len(fields) == 0 {
+		err = fmt.Errorf("collection %s has no full-text fields", kv.tab.Name)
+		return
+	}
+
+	start, end := opts.HighlightStart, opts.HighlightEnd
+	if start == "" && end == "" {
+		start, end = "<b>", "</b>"
+	}
+	tokens := opts.SnippetTokens
+	if tokens <= 0 {
+		tokens = 16
+	}
+
+	// The matches are selected in a subquery so that Where sees only the
+	// collection's columns, not the full-text table's columns of the same
+	// name.
+	fts := kv.FullTextTableName()
+	s := strings.Builder{}
+	s.WriteString("SELECT ")
+	s.WriteString(kv.opts.KeyField.Name)
+	s.WriteString(", flags")
+	for _, f := range kv.opts.Fields {
+		s.WriteString(", ")
+		s.WriteString(f.Name)
+	}
+	s.WriteString(", val, m.kv_rank")
+	for i := range fields {
+		if opts.Highlight {
+			fmt.Fprintf(&s, ", m.kv_highlight%d", i)
+		}
+		if opts.Snippet {
+			fmt.Fprintf(&s, ", m.kv_snippet%d", i)
+		}
+	}
+	s.WriteString(" FROM (SELECT rowid AS kv_rowid, rank AS kv_rank")
+	for i := range fields {
+		if opts.Highlight {
+			fmt.Fprintf(&s, ", highlight(%s, %d, %s, %s) AS kv_highlight%d", fts, i, sqlQuote(start), sqlQuote(end), i)
+		}
+		if opts.Snippet {
+			fmt.Fprintf(&s, ", snippet(%s, %d, %s, %s, '...', %d) AS kv_snippet%d", fts, i, sqlQuote(start), sqlQuote(end), tokens, i)
+		}
+	}
+	fmt.Fprintf(&s, " FROM %s WHERE %s MATCH ?) m JOIN %s ON %s.rowid = m.kv_rowid WHERE flags & 1 = 0",
+		fts, fts, kv.tab.Name, kv.tab.Name)
+	if opts.Where != "" {
+		s.WriteString(" AND (")
+		s.WriteString(opts.Where)
+		s.WriteString(")")
+	}
+	s.WriteString(" ORDER BY m.kv_rank")
+	if opts.Limit > 0 || opts.Offset > 0 {
+		limit := opts.Limit
+		if limit <= 0 {
+			limit = -1
+		}
+		fmt.Fprintf(&s, " LIMIT %d OFFSET %d", limit, opts.Offset)
+	}
+
+	rowFn := func(rows *sql.Rows) (err error) {
+		var flags int64
+		var buf []byte
+		res := &SearchResult[T]{Obj: new(T)}
+
+		scanArgs := make([]any, 0, len(kv.opts.Fields)+4+2*len(fields))
+		scanArgs = append(scanArgs, kv.opts.KeyField.GetPtr(res.Obj), &flags)
+		for _, field := range kv.opts.Fields {
+			scanArgs = append(scanArgs, kv.scanArg(field, res.Obj))
+		}
+		scanArgs = append(scanArgs, &buf, &res.Rank)
+
+		highlights := make([]sql.NullString, len(fields))
+		snippets := make([]sql.NullString, len(fields))
+		for i := range fields {
+			if opts.Highlight {
+				scanArgs = append(scanArgs, &highlights[i])
+			}
+			if opts.Snippet {
+				scanArgs = append(scanArgs, &snippets[i])
+			}
+		}
+
+		err = rows.Scan(scanArgs...)
+		if err != nil {
+			return
+		}
+
+		err = kv.decode(buf, flags, res.Obj)
+		if err != nil {
+			return
+		}
+
+		if opts.Highlight {
+			res.Highlights = make(map[string]string, len(fields))
+		}
+		if opts.Snippet {
+			res.Snippets = make(map[string]string, len(fields))
+		}
+		for i, f := range fields {
+			if opts.Highlight {
+				res.Highlights[f.Name] = highlights[i].String
+			}
+			if opts.Snippet {
+				res.Snippets[f.Name] = snippets[i].String
+			}
+		}
+
+		list = append(list, res)
+		return
+	}
+
+	err = kv.tab.Select(s.String(), []any{query}, rowFn)
+	return
+}
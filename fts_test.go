@@ -0,0 +1,107 @@
+//go:build sqlite_fts5
+
+package sqlitekv
+
+import "testing"
+
+func openSearchUsers(t *testing.T) *KeyVal[testUser] {
+	t.Helper()
+	db := openTestDB(t)
+	name := nameField()
+	name.FullText = true
+	kv, err := NewKeyVal(db, "users", KeyValOptions[testUser]{
+		KeyField: userKeyField(),
+		Fields:   []*KeyValField[testUser]{name, emailField()},
+		Enc:      testEncoder(t, db, EncoderOptions{}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, u := range []*testUser{
+		{Id: 1, Name: "alice smith", Email: "alice@example.com"},
+		{Id: 2, Name: "bob smith", Email: "bob@example.com"},
+		{Id: 3, Name: "carol smith smith", Email: "carol@example.com"},
+		{Id: 4, Name: "dave jones", Email: "dave@example.com"},
+	} {
+		err = kv.Upsert(u)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return kv
+}
+
+func searchIDs(t *testing.T, kv *KeyVal[testUser], query string, opts SearchOptions) (ids []int64) {
+	t.Helper()
+	list, err := kv.Search(query, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, res := range list {
+		ids = append(ids, res.Obj.Id)
+	}
+	return
+}
+
+func TestSearch(t *testing.T) {
+	kv := openSearchUsers(t)
+
+	ids := searchIDs(t, kv, "smith", SearchOptions{})
+	if len(ids) != 3 || ids[0] != 3 {
+		t.Errorf("smith = %v, want 3 matches with 3 first", ids)
+	}
+
+	// Offset without Limit returns the rest.
+	if ids := searchIDs(t, kv, "smith", SearchOptions{Offset: 1}); len(ids) != 2 {
+		t.Errorf("smith offset 1 = %v", ids)
+	}
+	if ids := searchIDs(t, kv, "smith", SearchOptions{Limit: 1}); len(ids) != 1 {
+		t.Errorf("smith limit 1 = %v", ids)
+	}
+
+	// Where may name a full-text column.
+	ids = searchIDs(t, kv, "smith", SearchOptions{Where: "name = 'bob smith' OR email LIKE 'alice%'"})
+	if len(ids) != 2 {
+		t.Errorf("smith where = %v", ids)
+	}
+
+	_, err := kv.SoftDelete(int64(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ids := searchIDs(t, kv, "bob", SearchOptions{}); len(ids) != 0 {
+		t.Errorf("soft-deleted row found: %v", ids)
+	}
+	_, err = kv.Undelete(int64(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ids := searchIDs(t, kv, "bob", SearchOptions{}); len(ids) != 1 {
+		t.Errorf("undeleted row not found: %v", ids)
+	}
+}
+
+func TestSearchHighlight(t *testing.T) {
+	kv := openSearchUsers(t)
+	list, err := kv.Search("jones", SearchOptions{Highlight: true, Snippet: true})
+	if err != nil || len(list) != 1 {
+		t.Fatalf("Search = %v, %v", list, err)
+	}
+	res := list[0]
+	if res.Highlights["name"] != "dave <b>jones</b>" || res.Snippets["name"] != "dave <b>jones</b>" {
+		t.Errorf("highlights %v, snippets %v", res.Highlights, res.Snippets)
+	}
+}
+
+func TestFullTextNeedsIntegerKey(t *testing.T) {
+	db := openTestDB(t)
+	_, err := NewDocumentCollection(db, "docs", DocumentOptions{
+		KeyField: DocumentField{Path: "id", Type: "TEXT"},
+		Fields:   []DocumentField{{Path: "title", Type: "TEXT", FullText: true}},
+		Enc:      testEncoder(t, db, EncoderOptions{}),
+	})
+	if err == nil {
+		t.Error("full-text field with a TEXT key was accepted")
+	}
+}
@@ -0,0 +1,421 @@
+package sqlitekv
+
+import (
+	"database/sql"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const earthRadius = 6371008.8 // meters
+
+type GeoPoint struct {
+	Lat float64 `json:"lat"`
+	Lon float64 `json:"lon"`
+}
+
+// GeoBox is a latitude/longitude rectangle. A box with MinLon > MaxLon
+// crosses the antimeridian.
+type GeoBox struct {
+	MinLat float64
+	MinLon float64
+	MaxLat float64
+	MaxLon float64
+}
+
+type GeoResult[T any] struct {
+	Obj *T
+	// Distance is the great-circle distance in meters.
+	Distance float64
+}
+
+// Distance returns the great-circle distance between p and q in meters.
+func (p GeoPoint) Distance(q GeoPoint) float64 {
+	lat1, lat2 := p.Lat*math.Pi/180, q.Lat*math.Pi/180
+	dLat := lat2 - lat1
+	dLon := (q.Lon - p.Lon) * math.Pi / 180
+
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1)*math.Cos(lat2)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadius * math.Asin(math.Min(1, math.Sqrt(a)))
+}
+
+func toGeoPoint(v any) (p GeoPoint, err error) {
+	switch g := v.(type) {
+	case GeoPoint:
+		p = g
+	case *GeoPoint:
+		p = *g
+	case [2]float64:
+		p = GeoPoint{Lat: g[0], Lon: g[1]}
+	case []any:
+		if len(g) != 2 {
+			return p, fmt.Errorf("geo value must be [lat, lon]")
+		}
+		p.Lat, err = geoNumber(g[0])
+		if err == nil {
+			p.Lon, err = geoNumber(g[1])
+		}
+	case map[string]any:
+		p.Lat, err = geoNumber(g["lat"])
+		if err == nil {
+			p.Lon, err = geoNumber(g["lon"])
+		}
+	default:
+		return p, fmt.Errorf("cannot convert %T to a geo point", v)
+	}
+	if err != nil {
+		return
+	}
+
+	if p.Lat < -90 || p.Lat > 90 || p.Lon < -180 || p.Lon > 180 || math.IsNaN(p.Lat) || math.IsNaN(p.Lon) {
+		err = fmt.Errorf("geo point out of range: %v, %v", p.Lat, p.Lon)
+	}
+	return
+}
+
+func geoNumber(v any) (float64, error) {
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(rv.Int()), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(rv.Uint()), nil
+	case reflect.Float32, reflect.Float64:
+		return rv.Float(), nil
+	}
+	return 0, fmt.Errorf("geo coordinate must be a number, got %T", v)
+}
+
+// geoColumnValue returns the column text for a geo value; a nil *GeoPoint
+// is stored as NULL.
+func geoColumnValue(v any) (any, error) {
+	if p, ok := v.(*GeoPoint); ok && p == nil {
+		return nil, nil
+	}
+
+	p, err := toGeoPoint(v)
+	if err != nil {
+		return nil, err
+	}
+	return "[" + strconv.FormatFloat(p.Lat, 'g', -1, 64) + "," + strconv.FormatFloat(p.Lon, 'g', -1, 64) + "]", nil
+}
+
+func (kv *KeyVal[T]) geoField() *KeyValField[T] {
+	for _, f := range kv.opts.Fields {
+		if f.Geo {
+			return f
+		}
+	}
+	return nil
+}
+
+func (kv *KeyVal[T]) GeoTableName() string {
+	if f := kv.geoField(); f != nil {
+		return kv.tab.Name + "_" + f.Name + "_rtree"
+	}
+	return ""
+}
+
+// syncGeo creates the R*Tree of the geo field and the triggers keeping it in
+// sync, and drops R*Trees of fields that are no longer geo fields. The
+// R*Tree holds soft-deleted rows too; queries filter them like Select.
+func (kv *KeyVal[T]) syncGeo() (err error) {
+	want := kv.GeoTableName()
+
+	// Other collections' tables can share the prefix, so an R*Tree is ours
+	// when its insert trigger is on our table.
+	rows, err := kv.db.Query(`SELECT name FROM sqlite_master t WHERE type = 'table' AND sql LIKE '%USING rtree%'
+		AND (name = ? OR EXISTS (SELECT 1 FROM sqlite_master WHERE type = 'trigger'
+			AND name = t.name || '_ai' AND tbl_name = ?))`,
+		want, kv.tab.Name)
+	if err != nil {
+		return
+	}
+
+	var existing []string
+	for rows.Next() {
+		var name string
+		err = rows.Scan(&name)
+		if err != nil {
+			rows.Close()
+			return
+		}
+		existing = append(existing, name)
+	}
+	rows.Close()
+	err = rows.Err()
+	if err != nil {
+		return
+	}
+
+	tx, err := kv.db.Begin()
+	if err != nil {
+		return
+	}
+	defer tx.Rollback()
+
+	found := false
+	for _, name := range existing {
+		if name == want {
+			found = true
+			continue
+		}
+		for _, s := range []string{"_ai", "_ad", "_au"} {
+			_, err = tx.Exec(fmt.Sprintf("DROP TRIGGER IF EXISTS %s%s", name, s))
+			if err != nil {
+				return
+			}
+		}
+		_, err = tx.Exec(fmt.Sprintf("DROP TABLE %s", name))
+		if err != nil {
+			return
+		}
+	}
+
+	if want != "" && !found {
+		col := kv.geoField().Name
+		insertNew := fmt.Sprintf(`INSERT INTO %[1]s(id, min_lat, max_lat, min_lon, max_lon)
+			SELECT new.rowid, json_extract(new.%[2]s, '$[0]'), json_extract(new.%[2]s, '$[0]'),
+			json_extract(new.%[2]s, '$[1]'), json_extract(new.%[2]s, '$[1]') WHERE new.%[2]s IS NOT NULL;`, want, col)
+		deleteOld := fmt.Sprintf("DELETE FROM %s WHERE id = old.rowid;", want)
+
+		for _, s := range []string{
+			fmt.Sprintf("CREATE VIRTUAL TABLE %s USING rtree(id, min_lat, max_lat, min_lon, max_lon)", want),
+			fmt.Sprintf("CREATE TRIGGER %s_ai AFTER INSERT ON %s BEGIN %s END", want, kv.tab.Name, insertNew),
+			fmt.Sprintf("CREATE TRIGGER %s_ad AFTER DELETE ON %s BEGIN %s END", want, kv.tab.Name, deleteOld),
+			fmt.Sprintf("CREATE TRIGGER %s_au AFTER UPDATE ON %s WHEN old.%s IS NOT new.%s BEGIN %s %s END",
+				want, kv.tab.Name, col, col, deleteOld, insertNew),
+			fmt.Sprintf(`INSERT INTO %[1]s(id, min_lat, max_lat, min_lon, max_lon)
+				SELECT rowid, json_extract(%[2]s, '$[0]'), json_extract(%[2]s, '$[0]'),
+				json_extract(%[2]s, '$[1]'), json_extract(%[2]s, '$[1]') FROM %[3]s WHERE %[2]s IS NOT NULL`,
+				want, col, kv.tab.Name),
+		} {
+			_, err = tx.Exec(s)
+			if err != nil {
+				return fmt.Errorf("geo index %s: %w", want, err)
+			}
+		}
+	}
+
+	return tx.Commit()
+}
+
+// geoCandidates returns rowid and location of the live rows in box. The
+// R*Tree stores 32-bit bounds, so it is searched for overlap and the exact
+// locations are compared afterwards.
+func (kv *KeyVal[T]) geoCandidates(box GeoBox) (ids []int64, points []GeoPoint, err error) {
+	rtree := kv.GeoTableName()
+	col := kv.geoField().Name
+
+	lonCond := "r.max_lon >= ? AND r.min_lon <= ?"
+	if box.MinLon > box.MaxLon {
+		lonCond = "(r.max_lon >= ? OR r.min_lon <= ?)"
+	}
+
+	q := fmt.Sprintf(`SELECT t.rowid, json_extract(t.%[1]s, '$[0]'), json_extract(t.%[1]s, '$[1]')
+		FROM %[2]s r JOIN %[3]s t ON t.rowid = r.id
+		WHERE r.max_lat >= ? AND r.min_lat <= ? AND %[4]s AND t.flags & 1 = 0`, col, rtree, kv.tab.Name, lonCond)
+
+	err = kv.tab.Select(q, []any{box.MinLat, box.MaxLat, box.MinLon, box.MaxLon}, func(rows *sql.Rows) (err error) {
+		var id int64
+		var p GeoPoint
+		err = rows.Scan(&id, &p.Lat, &p.Lon)
+		if err != nil {
+			return
+		}
+		if !box.contains(p) {
+			return
+		}
+		ids = append(ids, id)
+		points = append(points, p)
+		return
+	})
+	return
+}
+
+func (b GeoBox) contains(p GeoPoint) bool {
+	if p.Lat < b.MinLat || p.Lat > b.MaxLat {
+		return false
+	}
+	if b.MinLon > b.MaxLon {
+		return p.Lon >= b.MinLon || p.Lon <= b.MaxLon
+	}
+	return p.Lon >= b.MinLon && p.Lon <= b.MaxLon
+}
+
+// getByRowids returns the live objects with the given rowids.
+func (kv *KeyVal[T]) getByRowids(ids []int64) (byId map[int64]*T, err error) {
+	byId = make(map[int64]*T, len(ids))
+	if len(ids) == 0 {
+		return
+	}
+
+	s := strings.Builder{}
+	s.WriteString("SELECT rowid, ")
+	s.WriteString(kv.opts.KeyField.Name)
+	s.WriteString(", flags")
+	for _, f := range kv.opts.Fields {
+		s.WriteString(", ")
+		s.WriteString(f.Name)
+	}
+	s.WriteString(", val FROM ")
+	s.WriteString(kv.tab.Name)
+	s.WriteString(" WHERE flags & 1 = 0 AND rowid IN (")
+	args := make([]any, len(ids))
+	for i, id := range ids {
+		if i > 0 {
+			s.WriteString(", ")
+		}
+		s.WriteString("?")
+		args[i] = id
+	}
+	s.WriteString(")")
+
+	err = kv.tab.Select(s.String(), args, func(rows *sql.Rows) (err error) {
+		var rowid, flags int64
+		var buf []byte
+		obj := new(T)
+
+		scanArgs := make([]any, 0, len(kv.opts.Fields)+4)
+		scanArgs = append(scanArgs, &rowid, kv.opts.KeyField.GetPtr(obj), &flags)
+		for _, field := range kv.opts.Fields {
+			scanArgs = append(scanArgs, kv.scanArg(field, obj))
+		}
+		scanArgs = append(scanArgs, &buf)
+
+		err = rows.Scan(scanArgs...)
+		if err != nil {
+			return
+		}
+
+		err = kv.decode(buf, flags, obj)
+		if err != nil {
+			return
+		}
+		byId[rowid] = obj
+		return
+	})
+	return
+}
+
+// WithinBox returns the live objects whose geo field lies in box.
+func (kv *KeyVal[T]) WithinBox(box GeoBox) (list []*T, err error) {
+	if kv.geoField() == nil {
+		return nil, fmt.Errorf("collection %s has no geo field", kv.tab.Name)
+	}
+
+	ids, _, err := kv.geoCandidates(box)
+	if err != nil {
+		return
+	}
+
+	byId, err := kv.getByRowids(ids)
+	if err != nil {
+		return
+	}
+
+	list = make([]*T, 0, len(byId))
+	for _, id := range ids {
+		if obj, ok := byId[id]; ok {
+			list = append(list, obj)
+		}
+	}
+	return
+}
+
+// Nearest returns the k live objects closest to lat, lon, nearest first. It
+// searches boxes of growing radius until k objects are found within it.
+func (kv *KeyVal[T]) Nearest(lat, lon float64, k int) (list []*GeoResult[T], err error) {
+	list = make([]*GeoResult[T], 0, k)
+	if kv.geoField() == nil {
+		return nil, fmt.Errorf("collection %s has no geo field", kv.tab.Name)
+	}
+	if k <= 0 {
+		return
+	}
+
+	center, err := toGeoPoint(GeoPoint{Lat: lat, Lon: lon})
+	if err != nil {
+		return
+	}
+
+	type candidate struct {
+		id   int64
+		dist float64
+	}
+	var found []candidate
+
+	for radius := 1000.0; ; radius *= 4 {
+		box, whole := geoBoxAround(center, radius)
+
+		var ids []int64
+		var points []GeoPoint
+		ids, points, err = kv.geoCandidates(box)
+		if err != nil {
+			return
+		}
+
+		found = found[:0]
+		for i, id := range ids {
+			found = append(found, candidate{id: id, dist: center.Distance(points[i])})
+		}
+		sort.Slice(found, func(i, j int) bool { return found[i].dist < found[j].dist })
+
+		// Points within radius are all inside the box, so the k-th nearest
+		// is final once it is within radius.
+		if whole || (len(found) >= k && found[k-1].dist <= radius) {
+			break
+		}
+	}
+
+	found = found[:min(k, len(found))]
+	ids := make([]int64, len(found))
+	for i, c := range found {
+		ids[i] = c.id
+	}
+
+	byId, err := kv.getByRowids(ids)
+	if err != nil {
+		return
+	}
+
+	// A row deleted in between is skipped.
+	for _, c := range found {
+		if obj, ok := byId[c.id]; ok {
+			list = append(list, &GeoResult[T]{Obj: obj, Distance: c.dist})
+		}
+	}
+	return
+}
+
+// geoBoxAround returns a box containing every point within radius meters of
+// p, and whether it covers the whole globe.
+func geoBoxAround(p GeoPoint, radius float64) (box GeoBox, whole bool) {
+	r := radius / earthRadius
+	if r >= math.Pi {
+		return GeoBox{MinLat: -90, MinLon: -180, MaxLat: 90, MaxLon: 180}, true
+	}
+
+	dLat := r * 180 / math.Pi
+	box.MinLat = math.Max(-90, p.Lat-dLat)
+	box.MaxLat = math.Min(90, p.Lat+dLat)
+	box.MinLon, box.MaxLon = -180, 180
+
+	// Circles that contain a pole span every longitude.
+	x := math.Sin(r) / math.Cos(p.Lat*math.Pi/180)
+	if box.MinLat > -90 && box.MaxLat < 90 && x < 1 {
+		dLon := math.Asin(x) * 180 / math.Pi
+		box.MinLon = p.Lon - dLon
+		box.MaxLon = p.Lon + dLon
+		if box.MinLon < -180 {
+			box.MinLon += 360
+		}
+		if box.MaxLon > 180 {
+			box.MaxLon -= 360
+		}
+	}
+	return
+}
@@ -0,0 +1,78 @@
+package sqlitekv
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+)
+
+type testPlace struct {
+	Id  int64    `json:"id"`
+	Loc GeoPoint `json:"loc"`
+}
+
+func openPlaces(t *testing.T, db *sql.DB, name string) *KeyVal[testPlace] {
+	t.Helper()
+	kv, err := NewKeyVal(db, name, KeyValOptions[testPlace]{
+		KeyField: &KeyValField[testPlace]{Name: "id", Type: "INTEGER",
+			Get: func(p *testPlace) any { return p.Id }, GetPtr: func(p *testPlace) any { return &p.Id }},
+		Fields: []*KeyValField[testPlace]{{Name: "loc", Geo: true, Nullable: true,
+			Get: func(p *testPlace) any { return p.Loc }, GetPtr: func(p *testPlace) any { return &p.Loc }}},
+		Enc: testEncoder(t, db, EncoderOptions{}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return kv
+}
+
+func TestSyncGeoKeepsOtherCollections(t *testing.T) {
+	db := openTestDB(t)
+	places := openPlaces(t, db, "user_places")
+	err := places.Upsert(&testPlace{Id: 1, Loc: GeoPoint{Lat: 18.5, Lon: 73.8}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = NewKeyVal(db, "user", KeyValOptions[testUser]{
+		KeyField: userKeyField(),
+		Enc:      testEncoder(t, db, EncoderOptions{}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	list, err := places.WithinBox(GeoBox{MinLat: 18, MinLon: 73, MaxLat: 19, MaxLon: 74})
+	if err != nil || len(list) != 1 {
+		t.Fatalf("WithinBox = %v, %v", list, err)
+	}
+}
+
+func TestVerifyGeoColumn(t *testing.T) {
+	db := openTestDB(t)
+	places := openPlaces(t, db, "places")
+	err := places.Upsert(&testPlace{Id: 1, Loc: GeoPoint{Lat: 1, Lon: 2}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := places.Verify(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.OK() {
+		t.Errorf("report = %+v", report.Issues)
+	}
+}
+
+func TestGeoNeedsIntegerKey(t *testing.T) {
+	db := openTestDB(t)
+	_, err := NewDocumentCollection(db, "places", DocumentOptions{
+		KeyField: DocumentField{Path: "id", Type: "TEXT"},
+		Fields:   []DocumentField{{Path: "loc", Geo: true, Nullable: true}},
+		Enc:      testEncoder(t, db, EncoderOptions{}),
+	})
+	if err == nil {
+		t.Error("geo field with a TEXT key was accepted")
+	}
+}
@@ -0,0 +1,276 @@
+package sqlitekv
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+type HistoryEntry[T any] struct {
+	Version   int64
+	ValidFrom time.Time
+	// ValidTo is zero for the current version.
+	ValidTo time.Time
+	Deleted bool
+	Value   *T
+}
+
+func (kv *KeyVal[T]) HistoryTableName() string {
+	return kv.tab.Name + "_history"
+}
+
+func (kv *KeyVal[T]) historyColumns() []string {
+	cols := []string{kv.opts.KeyField.Name, "flags"}
+	for _, f := range kv.opts.Fields {
+		cols = append(cols, f.Name)
+	}
+	return append(cols, "val")
+}
+
+// historyType is the type of f's column in the history table, which holds
+// the column as stored.
+func historyType[T any](f *KeyValField[T]) string {
+	switch {
+	case f.Encrypted || f.BlindIndex || f.VectorDims > 0:
+		return "BLOB"
+	case f.Geo:
+		return "TEXT"
+	}
+	return f.Type
+}
+
+func (kv *KeyVal[T]) historySql() (table string, triggers []string) {
+	hist := kv.HistoryTableName()
+	key := kv.opts.KeyField.Name
+	now := "CAST(unixepoch('subsec') * 1000 AS INTEGER)"
+
+	s := strings.Builder{}
+	fmt.Fprintf(&s, "CREATE TABLE %s (version INTEGER PRIMARY KEY AUTOINCREMENT, %s %s NOT NULL, flags INTEGER NOT NULL",
+		hist, key, kv.opts.KeyField.Type)
+	for _, f := range kv.opts.Fields {
+		fmt.Fprintf(&s, ", %s %s", f.Name, historyType(f))
+	}
+	s.WriteString(", val BLOB, valid_from INTEGER NOT NULL, valid_to INTEGER)")
+	table = s.String()
+
+	cols := kv.historyColumns()
+	newCols := make([]string, len(cols))
+	for i, c := range cols {
+		newCols[i] = "new." + c
+	}
+	closeOld := fmt.Sprintf("UPDATE %s SET valid_to = %s WHERE %s = old.%s AND valid_to IS NULL;", hist, now, key, key)
+	insertNew := fmt.Sprintf("INSERT INTO %s (%s, valid_from) VALUES (%s, %s);",
+		hist, strings.Join(cols, ", "), strings.Join(newCols, ", "), now)
+
+	triggers = []string{
+		fmt.Sprintf("CREATE TRIGGER %s_ai AFTER INSERT ON %s BEGIN %s %s END",
+			hist, kv.tab.Name, strings.ReplaceAll(closeOld, "old.", "new."), insertNew),
+		fmt.Sprintf("CREATE TRIGGER %s_au AFTER UPDATE ON %s WHEN old.flags IS NOT new.flags OR old.val IS NOT new.val BEGIN %s %s END",
+			hist, kv.tab.Name, closeOld, insertNew),
+		fmt.Sprintf("CREATE TRIGGER %s_ad AFTER DELETE ON %s BEGIN %s END", hist, kv.tab.Name, closeOld),
+	}
+	return
+}
+
+// tableColumns returns the column names of a table, none if it doesn't
+// exist.
+func tableColumns(db *sql.DB, table string) (cols map[string]bool, err error) {
+	rows, err := db.Query(`SELECT name FROM pragma_table_info(?)`, table)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	cols = make(map[string]bool)
+	for rows.Next() {
+		var name string
+		err = rows.Scan(&name)
+		if err != nil {
+			return
+		}
+		cols[name] = true
+	}
+
+	err = rows.Err()
+	return
+}
+
+// syncHistory creates the history table, seeded with the current rows, and
+// its triggers. Fields added later get a column, NULL in older versions.
+// Turning history off drops the triggers and keeps the table.
+func (kv *KeyVal[T]) syncHistory() (err error) {
+	hist := kv.HistoryTableName()
+	table, want := kv.historySql()
+	if !kv.opts.KeepHistory {
+		want = nil
+	}
+
+	var current []string
+	rows, err := kv.db.Query(`SELECT sql FROM sqlite_master WHERE type = 'trigger' AND name IN (?, ?, ?)
+		ORDER BY name = ? DESC, name = ? DESC`,
+		hist+"_ai", hist+"_au", hist+"_ad", hist+"_ai", hist+"_au")
+	if err != nil {
+		return
+	}
+	for rows.Next() {
+		var s string
+		err = rows.Scan(&s)
+		if err != nil {
+			rows.Close()
+			return
+		}
+		current = append(current, s)
+	}
+	rows.Close()
+	err = rows.Err()
+	if err != nil {
+		return
+	}
+
+	if strings.Join(current, ";") == strings.Join(want, ";") {
+		return
+	}
+
+	cols, err := tableColumns(kv.db, hist)
+	if err != nil {
+		return
+	}
+
+	tx, err := kv.db.Begin()
+	if err != nil {
+		return
+	}
+	defer tx.Rollback()
+
+	for _, s := range []string{"_ai", "_au", "_ad"} {
+		_, err = tx.Exec(fmt.Sprintf("DROP TRIGGER IF EXISTS %s%s", hist, s))
+		if err != nil {
+			return
+		}
+	}
+
+	if want != nil {
+		for _, f := range kv.opts.Fields {
+			if len(cols) > 0 && !cols[f.Name] {
+				_, err = tx.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", hist, f.Name, historyType(f)))
+				if err != nil {
+					return
+				}
+			}
+		}
+
+		if len(cols) == 0 {
+			cols := strings.Join(kv.historyColumns(), ", ")
+			for _, s := range []string{
+				table,
+				fmt.Sprintf("CREATE INDEX %s_key_idx ON %s (%s, version)", hist, hist, kv.opts.KeyField.Name),
+				fmt.Sprintf("INSERT INTO %s (%s, valid_from) SELECT %s, CAST(unixepoch('subsec') * 1000 AS INTEGER) FROM %s",
+					hist, cols, cols, kv.tab.Name),
+			} {
+				_, err = tx.Exec(s)
+				if err != nil {
+					return
+				}
+			}
+		}
+
+		for _, s := range want {
+			_, err = tx.Exec(s)
+			if err != nil {
+				return
+			}
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (kv *KeyVal[T]) historyEntries(where string, args ...any) (list []*HistoryEntry[T], err error) {
+	if !kv.opts.KeepHistory {
+		return nil, fmt.Errorf("collection %s does not keep history", kv.tab.Name)
+	}
+
+	q := fmt.Sprintf("SELECT version, %s, flags, val, valid_from, valid_to FROM %s WHERE %s ORDER BY version",
+		kv.opts.KeyField.Name, kv.HistoryTableName(), where)
+
+	list = make([]*HistoryEntry[T], 0)
+	err = kv.tab.Select(q, args, func(rows *sql.Rows) (err error) {
+		var e HistoryEntry[T]
+		var pkey any
+		var flags, from int64
+		var to sql.NullInt64
+		var buf []byte
+		err = rows.Scan(&e.Version, &pkey, &flags, &buf, &from, &to)
+		if err != nil {
+			return
+		}
+
+		e.ValidFrom = time.UnixMilli(from)
+		if to.Valid {
+			e.ValidTo = time.UnixMilli(to.Int64)
+		}
+		e.Deleted = flags&EncodeSoftDelete != 0
+
+		opts, err := kv.decodeOptions(flags, pkey)
+		if err != nil {
+			return
+		}
+
+		e.Value = new(T)
+		err = kv.opts.Enc.Decode(buf, e.Value, flags, opts)
+		if err != nil {
+			return fmt.Errorf("version %d: %w", e.Version, err)
+		}
+
+		list = append(list, &e)
+		return
+	})
+	return
+}
+
+// History returns every version of pkey, oldest first.
+//
+// The history table <table>_history is written by triggers: each write
+// closes the open version of the key by setting valid_to and adds the new
+// one. The current version is the one with valid_to NULL; deleted keys have
+// none. Values are copied as stored, so they decode with the collection's
+// Encoder and dictionaries.
+func (kv *KeyVal[T]) History(pkey any) (list []*HistoryEntry[T], err error) {
+	return kv.historyEntries(kv.opts.KeyField.Name+" = ?", pkey)
+}
+
+// GetAsOf fills obj with the version of pkey that was current at t. It
+// reports false if the key did not exist or was soft-deleted then.
+func (kv *KeyVal[T]) GetAsOf(pkey any, t time.Time, obj *T) (ok bool, err error) {
+	ms := t.UnixMilli()
+	list, err := kv.historyEntries(kv.opts.KeyField.Name+` = ? AND version = (SELECT MAX(version) FROM `+
+		kv.HistoryTableName()+` WHERE `+kv.opts.KeyField.Name+` = ? AND valid_from <= ? AND (valid_to IS NULL OR valid_to > ?))`,
+		pkey, pkey, ms, ms)
+	if err != nil || len(list) == 0 || list[0].Deleted {
+		return
+	}
+
+	*obj = *list[0].Value
+	return true, nil
+}
+
+// Revert makes the given version of pkey current again, soft-deleted if it
+// was. It is written like an Upsert and so becomes a new version itself.
+func (kv *KeyVal[T]) Revert(pkey any, version int64) (err error) {
+	return kv.RevertContext(context.Background(), pkey, version)
+}
+
+func (kv *KeyVal[T]) RevertContext(ctx context.Context, pkey any, version int64) (err error) {
+	list, err := kv.historyEntries(kv.opts.KeyField.Name+" = ? AND version = ?", pkey, version)
+	if err != nil {
+		return
+	}
+	if len(list) == 0 {
+		return fmt.Errorf("version %d of %v not found", version, pkey)
+	}
+
+	e := list[0]
+	return kv.upsertBatch(ctx, []*T{e.Value}, []bool{e.Deleted}, true)
+}
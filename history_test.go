@@ -0,0 +1,139 @@
+package sqlitekv
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+)
+
+func openHistoryUsers(t *testing.T, db *sql.DB, fields ...*KeyValField[testUser]) *KeyVal[testUser] {
+	t.Helper()
+	kv, err := NewKeyVal(db, "users", KeyValOptions[testUser]{
+		KeyField:    userKeyField(),
+		Fields:      fields,
+		Enc:         testEncoder(t, db, EncoderOptions{}),
+		KeepHistory: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return kv
+}
+
+// tick makes the next write start in a later millisecond than the last.
+func tick() time.Time {
+	time.Sleep(3 * time.Millisecond)
+	t := time.Now()
+	time.Sleep(3 * time.Millisecond)
+	return t
+}
+
+func TestHistory(t *testing.T) {
+	db := openTestDB(t)
+	kv := openHistoryUsers(t, db, emailField())
+
+	before := tick()
+	err := kv.Upsert(&testUser{Id: 1, Name: "a", Email: "a@b.c"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := tick()
+	err = kv.Upsert(&testUser{Id: 1, Name: "b", Email: "b@b.c"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	second := tick()
+	_, err = kv.SoftDelete(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deleted := tick()
+
+	list, err := kv.History(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 3 {
+		t.Fatalf("History = %d versions, want 3", len(list))
+	}
+	if list[0].Value.Name != "a" || list[1].Value.Name != "b" || !list[2].Deleted {
+		t.Fatalf("History = %+v %+v %+v", list[0], list[1], list[2])
+	}
+	if list[0].ValidTo.IsZero() || !list[2].ValidTo.IsZero() {
+		t.Fatalf("valid_to = %v, %v", list[0].ValidTo, list[2].ValidTo)
+	}
+
+	for _, c := range []struct {
+		at   time.Time
+		ok   bool
+		name string
+	}{
+		{before, false, ""},
+		{first, true, "a"},
+		{second, true, "b"},
+		{deleted, false, ""},
+	} {
+		var u testUser
+		ok, err := kv.GetAsOf(1, c.at, &u)
+		if err != nil || ok != c.ok || u.Name != c.name {
+			t.Errorf("GetAsOf(%v) = %v, %q, %v; want %v, %q", c.at, ok, u.Name, err, c.ok, c.name)
+		}
+	}
+
+	err = kv.Revert(1, list[0].Version)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var u testUser
+	ok, err := kv.Get(1, &u)
+	if err != nil || !ok || u.Name != "a" {
+		t.Fatalf("Get after Revert = %v, %+v, %v", ok, u, err)
+	}
+	list, err = kv.History(1)
+	if err != nil || len(list) != 4 {
+		t.Fatalf("History after Revert = %d, %v", len(list), err)
+	}
+}
+
+func TestHistoryAddField(t *testing.T) {
+	db := openTestDB(t)
+	kv := openHistoryUsers(t, db, emailField())
+	err := kv.Upsert(&testUser{Id: 1, Name: "a", Email: "a@b.c"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = db.Exec("ALTER TABLE users ADD COLUMN name TEXT")
+	if err != nil {
+		t.Fatal(err)
+	}
+	kv = openHistoryUsers(t, db, emailField(), nameField())
+
+	err = kv.Upsert(&testUser{Id: 1, Name: "b", Email: "a@b.c"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var names []sql.NullString
+	rows, err := db.Query("SELECT name FROM users_history WHERE id = 1 ORDER BY version")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name sql.NullString
+		err = rows.Scan(&name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, name)
+	}
+	if len(names) != 2 || names[0].Valid || names[1].String != "b" {
+		t.Fatalf("history names = %v", names)
+	}
+
+	list, err := kv.History(1)
+	if err != nil || len(list) != 2 || list[1].Value.Name != "b" {
+		t.Fatalf("History = %v, %v", list, err)
+	}
+}
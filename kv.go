@@ -1,9 +1,13 @@
 package sqlitekv
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
+	"slices"
+	"sort"
 	"strings"
+	"sync/atomic"
 )
 
 type KeyValField[T any] struct {
@@ -12,8 +16,35 @@ type KeyValField[T any] struct {
 	Unique   bool
 	Nullable bool
 	Indexed  bool
-	Get      func(t *T) any
-	GetPtr   func(t *T) any
+	// Encrypted stores the column as ciphertext. Such columns cannot be
+	// used in lookups. The value holds the field too, so the collection
+	// must use KeyValOptions.Encrypt.
+	Encrypted bool
+	// BlindIndex stores an HMAC of the value instead of the value. Exact
+	// matches through GetUnique and SelectOptions.Match hash the lookup
+	// value the same way. Like Encrypted it requires KeyValOptions.Encrypt.
+	BlindIndex bool
+	// FullText adds the column to the collection's FTS5 table (see
+	// KeyVal.Search). The key must be INTEGER.
+	FullText bool
+	// Geo stores a location, which Get returns as a GeoPoint, *GeoPoint or
+	// [2]float64, in an R*Tree for WithinBox and Nearest. The column holds
+	// [lat,lon] as JSON text. A collection can have one geo field, and its
+	// key must be INTEGER.
+	Geo bool
+	// VectorDims makes the field an embedding of that many dimensions, which
+	// Get returns as []float32 or []float64. It is stored as a float32 BLOB
+	// and searched with KeyVal.SimilarTo. A collection can have one vector
+	// field, and its key must be INTEGER.
+	VectorDims   int
+	VectorMetric VectorMetric
+	// Path is the dotted path of the value inside the document, for
+	// collections whose fields are extracted by path (see Document). The
+	// audit log also uses it to find the field in the value; without it the
+	// path is taken from the struct field GetPtr points to.
+	Path   string
+	Get    func(t *T) any
+	GetPtr func(t *T) any
 }
 
 type KeyValOptions[T any] struct {
@@ -25,20 +56,59 @@ type KeyValOptions[T any] struct {
 	Validate    func(*T) error
 	Compression bool
 	UseDict     bool
+	// DictKey shares a dictionary between collections. It is namespaced
+	// with SharedDictKey; when empty the table name is used.
+	DictKey string
+	// Encrypt seals every value with the Encoder's KeyProvider after
+	// compression, bound to the table name and primary key.
+	Encrypt bool
+	// Checksum prefixes every value with a CRC32C that is verified on
+	// decode.
+	Checksum bool
+	// JSONView maintains a view <table>_json with the key, the plain
+	// columns, the soft-delete state and the decoded value as JSON. Reading
+	// it needs the kv_decode function (see RegisterSQLFunctions).
+	JSONView bool
+	// PathIndexes are expression indexes on paths inside the value. Every
+	// connection that writes to the table needs the kv functions.
+	PathIndexes []PathIndex
+	// VectorIndex builds an in-memory IVF index over the vector field when
+	// the collection is opened. Without it SimilarTo scans every vector.
+	VectorIndex *VectorIndexOptions
+	// ChangeLog records every write in <table>_changes (see Changes).
+	ChangeLog *ChangeLogOptions
+	// KeepHistory records every version in <table>_history (see History).
+	KeepHistory bool
+	// Audit records who made each write in <table>_audit (see AuditLog).
+	Audit *AuditOptions
+	// ReadOnly opens an existing collection as it is stored, without
+	// creating or updating its table, its catalog entry or the tables,
+	// views and indexes derived from it, e.g. for tools that only read.
+	// Writes through it are not prevented but skip that setup.
+	ReadOnly bool
 }
 
 type KeyVal[T any] struct {
 	db            *sql.DB
 	opts          KeyValOptions[T]
 	tab           *Table
+	dictKey       string
 	flagsField    *KeyValField[T]
 	valField      *KeyValField[T]
-	latestDictVer uint8
+	latestDictVer uint32
 	encodeOpt     EncodeOptions
 	decodeOpts    DecodeOptions
+	vecIndex      atomic.Pointer[ivfIndex]
+	watch         watchHub[T]
+	auditRedact   []string
 }
 
 func NewKeyVal[T any](db *sql.DB, name string, opts KeyValOptions[T]) (kv *KeyVal[T], err error) {
+	err = validateFields(opts)
+	if err != nil {
+		return
+	}
+
 	flagsField := &KeyValField[T]{
 		Name: "flags",
 		Type: "INTEGER",
@@ -64,9 +134,20 @@ func NewKeyVal[T any](db *sql.DB, name string, opts KeyValOptions[T]) (kv *KeyVa
 	})
 
 	for _, f := range opts.Fields {
+		typ := f.Type
+		if f.Encrypted || f.BlindIndex {
+			typ = "BLOB"
+		}
+		if f.Geo {
+			typ = "TEXT"
+		}
+		if f.VectorDims > 0 {
+			typ = "BLOB"
+		}
+
 		tableFields = append(tableFields, TableField{
 			Name:       f.Name,
-			Type:       f.Type,
+			Type:       typ,
 			Unique:     f.Unique,
 			Nullable:   f.Nullable,
 			Indexed:    f.Indexed,
@@ -80,7 +161,8 @@ func NewKeyVal[T any](db *sql.DB, name string, opts KeyValOptions[T]) (kv *KeyVa
 	})
 
 	tab, err := NewTable(db, name, TableOptions{
-		Fields: tableFields,
+		Fields:   tableFields,
+		Existing: opts.ReadOnly,
 	})
 	if err != nil {
 		return
@@ -92,6 +174,11 @@ func NewKeyVal[T any](db *sql.DB, name string, opts KeyValOptions[T]) (kv *KeyVa
 		tab:        tab,
 		flagsField: flagsField,
 		valField:   valField,
+		dictKey:    tab.Name,
+	}
+
+	if kv.opts.DictKey != "" {
+		kv.dictKey = SharedDictKey(kv.opts.DictKey)
 	}
 
 	if kv.opts.Compression && kv.opts.UseDict {
@@ -101,45 +188,294 @@ func NewKeyVal[T any](db *sql.DB, name string, opts KeyValOptions[T]) (kv *KeyVa
 			return
 		}
 
-		kv.latestDictVer, err = dictColl.GetMaxVersion(kv.tab.Name)
+		kv.latestDictVer, err = dictColl.GetMaxVersion(kv.dictKey)
 		if err != nil {
 			return
 		}
 	}
 
-	if kv.latestDictVer == 0 && kv.opts.UseDict {
-		kv.opts.UseDict = false
-	}
-
 	kv.encodeOpt = EncodeOptions{
-		DictKey:  kv.tab.Name,
+		DictKey:  kv.dictKey,
 		Compress: kv.opts.Compression,
-		UseDict:  kv.opts.UseDict,
+		UseDict:  kv.opts.UseDict && kv.latestDictVer != 0,
 		DictVer:  kv.latestDictVer,
+		Encrypt:  kv.opts.Encrypt,
+		Checksum: kv.opts.Checksum,
 	}
 
 	kv.decodeOpts = DecodeOptions{
-		DictKey: kv.tab.Name,
+		DictKey: kv.dictKey,
+	}
+
+	if kv.opts.ReadOnly {
+		if kv.opts.VectorIndex != nil {
+			err = kv.RebuildVectorIndex()
+		}
+		return
+	}
+
+	cat, err := NewCatalog(db)
+	if err != nil {
+		return
+	}
+
+	changed, err := cat.Put(kv.Spec())
+	if err != nil {
+		return
+	}
+
+	err = kv.syncJSONView(changed)
+	if err != nil {
+		return
+	}
+
+	err = kv.syncPathIndexes()
+	if err != nil {
+		return
+	}
+
+	err = kv.syncFullText()
+	if err != nil {
+		return
+	}
+
+	err = kv.syncGeo()
+	if err != nil {
+		return
+	}
+
+	err = kv.syncChangeLog()
+	if err != nil {
+		return
+	}
+
+	err = kv.syncHistory()
+	if err != nil {
+		return
+	}
+
+	err = kv.syncAudit()
+	if err != nil {
+		return
+	}
+
+	if kv.opts.VectorIndex != nil {
+		err = kv.RebuildVectorIndex()
+		if err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+func validateFields[T any](opts KeyValOptions[T]) (err error) {
+	if opts.VectorIndex != nil && !slices.ContainsFunc(opts.Fields, func(f *KeyValField[T]) bool { return f.VectorDims > 0 }) {
+		return fmt.Errorf("vector index needs a vector field")
 	}
 
+	geoFields, vectorFields := 0, 0
+	for _, f := range opts.Fields {
+		if f.Encrypted && f.BlindIndex {
+			return fmt.Errorf("field %s: Encrypted and BlindIndex are mutually exclusive", f.Name)
+		}
+		if (f.Encrypted || f.BlindIndex) && !opts.Encrypt {
+			return fmt.Errorf("field %s: encrypted and blind-indexed fields need the value to be encrypted too", f.Name)
+		}
+		if f.Encrypted && f.Unique {
+			return fmt.Errorf("field %s: encrypted fields cannot be unique", f.Name)
+		}
+		if f.FullText && (f.Encrypted || f.BlindIndex) {
+			return fmt.Errorf("field %s: encrypted fields cannot be full-text indexed", f.Name)
+		}
+		if f.FullText && !rowidKey(opts.KeyField) {
+			return fmt.Errorf("field %s: full-text fields need an INTEGER key", f.Name)
+		}
+		if f.Geo {
+			geoFields++
+			if geoFields > 1 {
+				return fmt.Errorf("field %s: a collection can have only one geo field", f.Name)
+			}
+			if f.Encrypted || f.BlindIndex || f.FullText || f.Unique {
+				return fmt.Errorf("field %s: geo fields cannot be encrypted, full-text or unique", f.Name)
+			}
+			if !rowidKey(opts.KeyField) {
+				return fmt.Errorf("field %s: geo fields need an INTEGER key", f.Name)
+			}
+		}
+		if f.VectorDims > 0 {
+			vectorFields++
+			if vectorFields > 1 {
+				return fmt.Errorf("field %s: a collection can have only one vector field", f.Name)
+			}
+			if f.Encrypted || f.BlindIndex || f.FullText || f.Unique || f.Geo || f.Indexed {
+				return fmt.Errorf("field %s: vector fields cannot be encrypted, full-text, geo, unique or indexed", f.Name)
+			}
+			if !rowidKey(opts.KeyField) {
+				return fmt.Errorf("field %s: vector fields need an INTEGER key", f.Name)
+			}
+		}
+	}
+
+	if opts.Encrypt && (opts.Enc == nil || opts.Enc.KeyProvider() == nil) {
+		return fmt.Errorf("encoder must have a key provider to use encryption")
+	}
 	return
 }
 
+// rowidKey reports whether the key column is an alias for the rowid.
+// Tables that refer to rows by rowid need one, since VACUUM may renumber
+// other rowids.
+func rowidKey[T any](f *KeyValField[T]) bool {
+	return strings.EqualFold(f.Type, "INTEGER")
+}
+
 func (kv *KeyVal[T]) Table() *Table {
 	return kv.tab
 }
 
-func (kv *KeyVal[T]) makeInsertArgs(flags int64, buf []byte, obj *T) (args []any) {
+func (kv *KeyVal[T]) DictKey() string {
+	return kv.dictKey
+}
+
+// UseLatestDict switches encoding to the newest dictionary version of the
+// collection's key, e.g. after a shared dictionary was trained elsewhere or
+// imported.
+func (kv *KeyVal[T]) UseLatestDict() (err error) {
+	dictColl := kv.opts.Enc.DictCollection()
+	if dictColl == nil {
+		err = fmt.Errorf("encoder must have a dict collection to use dictionary compression")
+		return
+	}
+
+	ver, err := dictColl.GetMaxVersion(kv.dictKey)
+	if err != nil {
+		return
+	}
+
+	kv.latestDictVer = ver
+	kv.encodeOpt.DictVer = ver
+	kv.encodeOpt.UseDict = kv.opts.Compression && kv.opts.UseDict && ver != 0
+	return
+}
+
+func (kv *KeyVal[T]) encode(obj *T) (flags int64, buf []byte, err error) {
+	opts := kv.encodeOpt
+	if opts.Encrypt {
+		opts.AssocData, err = AssocData(kv.tab.Name, kv.opts.KeyField.Get(obj))
+		if err != nil {
+			return
+		}
+	}
+
+	return kv.opts.Enc.Encode(obj, opts)
+}
+
+// decode expects the key field of obj to be already scanned.
+func (kv *KeyVal[T]) decode(buf []byte, flags int64, obj *T) (err error) {
+	opts, err := kv.decodeOptions(flags, kv.opts.KeyField.Get(obj))
+	if err != nil {
+		return
+	}
+
+	// Decoding into a map adds to it, so documents start over instead of
+	// keeping the columns scanned into them.
+	if doc, ok := any(obj).(*Document); ok {
+		*doc = nil
+	}
+
+	return kv.opts.Enc.Decode(buf, obj, flags, opts)
+}
+
+func (kv *KeyVal[T]) decodeOptions(flags int64, pkey any) (opts DecodeOptions, err error) {
+	opts = kv.decodeOpts
+	opts.PKey = pkey
+	if IsEncrypted(flags) {
+		opts.AssocData, err = AssocData(kv.tab.Name, pkey)
+	}
+	return
+}
+
+func (kv *KeyVal[T]) makeInsertArgs(flags int64, buf []byte, obj *T) (args []any, err error) {
 	args = make([]any, len(kv.opts.Fields)+3)
 	args[0] = kv.opts.KeyField.Get(obj)
 	args[1] = flags
 	for i, field := range kv.opts.Fields {
-		args[i+2] = field.Get(obj)
+		args[i+2], err = kv.columnValue(field, obj)
+		if err != nil {
+			return
+		}
 	}
 	args[len(kv.opts.Fields)+2] = buf
 	return
 }
 
+func (kv *KeyVal[T]) columnValue(field *KeyValField[T], obj *T) (v any, err error) {
+	v = field.Get(obj)
+	if v == nil {
+		return
+	}
+
+	if field.Geo {
+		return geoColumnValue(v)
+	}
+
+	if field.VectorDims > 0 {
+		return vectorColumnValue(v, field.VectorDims)
+	}
+
+	if field.BlindIndex {
+		return kv.opts.Enc.blindIndex(kv.tab.Name, field.Name, v)
+	}
+
+	if field.Encrypted {
+		var ad []byte
+		ad, err = kv.fieldAssocData(field, kv.opts.KeyField.Get(obj))
+		if err != nil {
+			return
+		}
+		return kv.opts.Enc.encryptField(v, ad)
+	}
+	return
+}
+
+func (kv *KeyVal[T]) fieldAssocData(field *KeyValField[T], pkey any) ([]byte, error) {
+	return AssocData(kv.tab.Name+"."+field.Name, pkey)
+}
+
+// scanArg returns where a column is scanned to. Columns that don't hold the
+// plain value, or hold it in another form, are discarded; the decoded val fills in the field instead.
+func (kv *KeyVal[T]) scanArg(field *KeyValField[T], obj *T) any {
+	if field.Encrypted || field.BlindIndex || field.Geo || field.VectorDims > 0 {
+		return new(any)
+	}
+	return field.GetPtr(obj)
+}
+
+func (kv *KeyVal[T]) field(columnName string) *KeyValField[T] {
+	for _, f := range kv.opts.Fields {
+		if f.Name == columnName {
+			return f
+		}
+	}
+	return nil
+}
+
+// lookupValue converts v into what is stored in the column, for exact-match
+// conditions.
+func (kv *KeyVal[T]) lookupValue(columnName string, v any) (any, error) {
+	field := kv.field(columnName)
+	switch {
+	case field == nil || v == nil:
+		return v, nil
+	case field.Encrypted:
+		return nil, fmt.Errorf("field %s is encrypted and cannot be looked up", columnName)
+	case field.BlindIndex:
+		return kv.opts.Enc.blindIndex(kv.tab.Name, field.Name, v)
+	}
+	return v, nil
+}
+
 func (kv *KeyVal[T]) Get(pkey any, obj *T) (ok bool, err error) {
 	return kv.getUnique(kv.opts.KeyField.Name, pkey, obj)
 }
@@ -149,6 +485,11 @@ func (kv *KeyVal[T]) GetUnique(columnName string, pkey any, obj *T) (ok bool, er
 }
 
 func (kv *KeyVal[T]) getUnique(columnName string, pkey any, obj *T) (ok bool, err error) {
+	pkey, err = kv.lookupValue(columnName, pkey)
+	if err != nil {
+		return
+	}
+
 	scanArgs := make([]any, len(kv.opts.Fields)+3)
 	var flags int64
 	var buf []byte
@@ -156,7 +497,7 @@ func (kv *KeyVal[T]) getUnique(columnName string, pkey any, obj *T) (ok bool, er
 	scanArgs[0] = kv.opts.KeyField.GetPtr(obj)
 	scanArgs[1] = &flags
 	for i, field := range kv.opts.Fields {
-		scanArgs[i+2] = field.GetPtr(obj)
+		scanArgs[i+2] = kv.scanArg(field, obj)
 	}
 	scanArgs[len(kv.opts.Fields)+2] = &buf
 
@@ -183,7 +524,7 @@ func (kv *KeyVal[T]) getUnique(columnName string, pkey any, obj *T) (ok bool, er
 		return
 	}
 
-	err = kv.opts.Enc.Decode(buf, obj, flags, kv.decodeOpts)
+	err = kv.decode(buf, flags, obj)
 	if err != nil {
 		return
 	}
@@ -192,6 +533,12 @@ func (kv *KeyVal[T]) getUnique(columnName string, pkey any, obj *T) (ok bool, er
 }
 
 func (kv *KeyVal[T]) Insert(obj *T) (rid int64, err error) {
+	return kv.InsertContext(context.Background(), obj)
+}
+
+// InsertContext is Insert with a context, which also carries the AuditInfo
+// of the write (see WithAuditInfo).
+func (kv *KeyVal[T]) InsertContext(ctx context.Context, obj *T) (rid int64, err error) {
 	if kv.opts.Validate != nil {
 		err = kv.opts.Validate(obj)
 		if err != nil {
@@ -203,38 +550,130 @@ func (kv *KeyVal[T]) Insert(obj *T) (rid int64, err error) {
 		kv.opts.OnInsert(obj)
 	}
 
-	flags, buf, err := kv.opts.Enc.Encode(obj, kv.encodeOpt)
+	flags, buf, err := kv.encode(obj)
 	if err != nil {
 		return
 	}
 
-	args := kv.makeInsertArgs(flags, buf, obj)
-	rid, err = kv.tab.Insert(args...)
+	args, err := kv.makeInsertArgs(flags, buf, obj)
+	if err != nil {
+		return
+	}
 
+	stmt, err := kv.tab.insertStmt()
+	if err != nil {
+		return
+	}
+
+	if !kv.tracking() {
+		var res sql.Result
+		res, err = stmt.ExecContext(ctx, args...)
+		if err != nil {
+			return
+		}
+		return res.LastInsertId()
+	}
+
+	err = kv.inTx(ctx, func(tx *sql.Tx) (events []Event[T], err error) {
+		res, err := tx.StmtContext(ctx, stmt).ExecContext(ctx, args...)
+		if err != nil {
+			return
+		}
+
+		rid, err = res.LastInsertId()
+		if err != nil {
+			return
+		}
+
+		newObj, err := clone(obj)
+		if err != nil {
+			return
+		}
+		events = append(events, Event[T]{Type: Inserted, Key: args[0], New: newObj, op: OpInsert})
+		return
+	})
 	return
 }
 
 func (kv *KeyVal[T]) Upsert(obj *T) (err error) {
-	if kv.opts.Validate != nil {
-		err = kv.opts.Validate(obj)
+	return kv.UpsertContext(context.Background(), obj)
+}
+
+func (kv *KeyVal[T]) UpsertContext(ctx context.Context, obj *T) (err error) {
+	return kv.upsertBatch(ctx, []*T{obj}, nil, true)
+}
+
+// UpsertBatch upserts objs in a single transaction.
+func (kv *KeyVal[T]) UpsertBatch(objs []*T) (err error) {
+	return kv.UpsertBatchContext(context.Background(), objs)
+}
+
+func (kv *KeyVal[T]) UpsertBatchContext(ctx context.Context, objs []*T) (err error) {
+	return kv.upsertBatch(ctx, objs, nil, true)
+}
+
+// upsertBatch encodes objs and upserts them, in one transaction when there
+// is more than one. deleted, when not nil, marks objects to be stored
+// soft-deleted; hooks runs OnUpdate.
+func (kv *KeyVal[T]) upsertBatch(ctx context.Context, objs []*T, deleted []bool, hooks bool) (err error) {
+	rows := make([][]any, 0, len(objs))
+	for i, obj := range objs {
+		if kv.opts.Validate != nil {
+			err = kv.opts.Validate(obj)
+			if err != nil {
+				return
+			}
+		}
+
+		if hooks && kv.opts.OnUpdate != nil {
+			kv.opts.OnUpdate(obj)
+		}
+
+		var flags int64
+		var buf []byte
+		flags, buf, err = kv.encode(obj)
 		if err != nil {
 			return
 		}
-	}
 
-	if kv.opts.OnUpdate != nil {
-		kv.opts.OnUpdate(obj)
-	}
+		if deleted != nil && deleted[i] {
+			flags |= EncodeSoftDelete
+		}
 
-	flags, buf, err := kv.opts.Enc.Encode(obj, kv.encodeOpt)
-	if err != nil {
-		return
+		var args []any
+		args, err = kv.makeInsertArgs(flags, buf, obj)
+		if err != nil {
+			return
+		}
+		rows = append(rows, args)
 	}
 
-	args := kv.makeInsertArgs(flags, buf, obj)
-	_, err = kv.tab.Upsert(args...)
+	if !kv.tracking() {
+		if len(rows) == 1 {
+			var stmt *sql.Stmt
+			stmt, err = kv.tab.upsertStmt()
+			if err != nil {
+				return
+			}
+			_, err = stmt.ExecContext(ctx, rows[0]...)
+			return
+		}
+		return kv.tab.UpsertMany(rows)
+	}
 
-	return
+	return kv.inTx(ctx, func(tx *sql.Tx) (events []Event[T], err error) {
+		for i, args := range rows {
+			var ev *Event[T]
+			ev, err = kv.upsertTx(ctx, tx, objs[i], args)
+			if err != nil {
+				return
+			}
+			if ev != nil {
+				events = append(events, *ev)
+			}
+		}
+		return
+	})
 }
 
 type SelectOptions[T any] struct {
@@ -242,11 +681,36 @@ type SelectOptions[T any] struct {
 	Where    string
 	Limit    int
 	Order    string
+	// Match adds an exact-match condition per column, ANDed with Where.
+	// Its values are bound after bindargs, in column name order, and are
+	// hashed for blind-indexed columns. Keys starting with $ are value
+	// paths, matched with the same expression as PathIndexes.
+	Match map[string]any
 }
 
 func (kv *KeyVal[T]) Select(bindargs []any, opts SelectOptions[T]) (list []*T, err error) {
 	list = make([]*T, 0)
 
+	matchCols := make([]string, 0, len(opts.Match))
+	for col := range opts.Match {
+		if !kv.hasColumn(col) && !strings.HasPrefix(col, "$") {
+			err = fmt.Errorf("unknown match column: %q", col)
+			return
+		}
+		matchCols = append(matchCols, col)
+	}
+	sort.Strings(matchCols)
+
+	bindargs = slices.Clip(bindargs)
+	for _, col := range matchCols {
+		var v any
+		v, err = kv.lookupValue(col, opts.Match[col])
+		if err != nil {
+			return
+		}
+		bindargs = append(bindargs, v)
+	}
+
 	getSql := func() string {
 		s := strings.Builder{}
 		s.WriteString("SELECT ")
@@ -266,6 +730,15 @@ func (kv *KeyVal[T]) Select(bindargs []any, opts SelectOptions[T]) (list []*T, e
 			s.WriteString(opts.Where)
 			s.WriteString(") AND")
 		}
+		for _, col := range matchCols {
+			s.WriteString(" ")
+			if strings.HasPrefix(col, "$") {
+				s.WriteString(kv.ExtractSQL(col))
+			} else {
+				s.WriteString(col)
+			}
+			s.WriteString(" = ? AND")
+		}
 		s.WriteString(" flags & 1 = 0")
 
 		if opts.Order != "" {
@@ -288,7 +761,7 @@ func (kv *KeyVal[T]) Select(bindargs []any, opts SelectOptions[T]) (list []*T, e
 		scanArgs[0] = kv.opts.KeyField.GetPtr(obj)
 		scanArgs[1] = &flags
 		for i, field := range kv.opts.Fields {
-			scanArgs[i+2] = field.GetPtr(obj)
+			scanArgs[i+2] = kv.scanArg(field, obj)
 		}
 		scanArgs[len(kv.opts.Fields)+2] = &buf
 
@@ -297,7 +770,7 @@ func (kv *KeyVal[T]) Select(bindargs []any, opts SelectOptions[T]) (list []*T, e
 			return
 		}
 
-		err = kv.opts.Enc.Decode(buf, obj, flags, kv.decodeOpts)
+		err = kv.decode(buf, flags, obj)
 		if err != nil {
 			return
 		}
@@ -317,6 +790,10 @@ func (kv *KeyVal[T]) Select(bindargs []any, opts SelectOptions[T]) (list []*T, e
 }
 
 func (kv *KeyVal[T]) SoftDelete(pkey any) (affectedCount int64, err error) {
+	return kv.SoftDeleteContext(context.Background(), pkey)
+}
+
+func (kv *KeyVal[T]) SoftDeleteContext(ctx context.Context, pkey any) (affectedCount int64, err error) {
 	stmt, err := kv.tab.StmtStore().GetOrCreate(kv.db, "soft_delete_pkey", func() string {
 		return fmt.Sprintf(`update %s set flags=flags | 1 where %s=? and flags & 1 = 0`,
 			kv.tab.Name, kv.opts.KeyField.Name)
@@ -325,16 +802,30 @@ func (kv *KeyVal[T]) SoftDelete(pkey any) (affectedCount int64, err error) {
 		return
 	}
 
-	res, err := stmt.Exec(pkey)
+	return kv.execKey(ctx, stmt, pkey, OpSoftDelete)
+}
+
+func (kv *KeyVal[T]) Undelete(pkey any) (affectedCount int64, err error) {
+	return kv.UndeleteContext(context.Background(), pkey)
+}
+
+func (kv *KeyVal[T]) UndeleteContext(ctx context.Context, pkey any) (affectedCount int64, err error) {
+	stmt, err := kv.tab.StmtStore().GetOrCreate(kv.db, "undelete_pkey", func() string {
+		return fmt.Sprintf(`update %s set flags=flags & ~1 where %s=? and flags & 1 = 1`,
+			kv.tab.Name, kv.opts.KeyField.Name)
+	})
 	if err != nil {
 		return
 	}
 
-	affectedCount, err = res.RowsAffected()
-	return
+	return kv.execKey(ctx, stmt, pkey, OpUndelete)
 }
 
 func (kv *KeyVal[T]) Delete(pkey any) (affectedCount int64, err error) {
+	return kv.DeleteContext(context.Background(), pkey)
+}
+
+func (kv *KeyVal[T]) DeleteContext(ctx context.Context, pkey any) (affectedCount int64, err error) {
 	stmt, err := kv.tab.StmtStore().GetOrCreate(kv.db, "delete_pkey", func() string {
 		return fmt.Sprintf("delete from %s where %s=?", kv.tab.Name, kv.opts.KeyField.Name)
 	})
@@ -342,32 +833,10 @@ func (kv *KeyVal[T]) Delete(pkey any) (affectedCount int64, err error) {
 		return
 	}
 
-	res, err := stmt.Exec(pkey)
-	if err != nil {
-		return
-	}
-
-	affectedCount, err = res.RowsAffected()
-
-	return
+	return kv.execKey(ctx, stmt, pkey, OpDelete)
 }
 
 func (kv *KeyVal[T]) Train(limit int) (err error) {
-	selectSql := fmt.Sprintf("SELECT flags, val FROM %s WHERE (flags & 1 = 0) LIMIT %d",
-		kv.tab.Name, limit)
-	rows, err := kv.db.Query(selectSql)
-	if err != nil {
-		return
-	}
-	defer rows.Close()
-
-	d, err := kv.opts.Enc.TrainWithRows(kv.db, kv.tab.Name, selectSql)
-	if err != nil {
-		return
-	}
-
-	kv.latestDictVer = d.Ver
-	kv.encodeOpt.DictVer = d.Ver
-
+	_, err = kv.TrainWithOptions(TrainOptions{Limit: limit})
 	return
 }
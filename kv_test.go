@@ -0,0 +1,88 @@
+package sqlitekv
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+type testUser struct {
+	Id    int64  `json:"id"`
+	Name  string `json:"name"`
+	Email string `json:"email"`
+}
+
+// testFuncs provides the kv SQL functions on connections opened with
+// openTestFuncDB.
+var testFuncs = RegisterSQLFunctions("sqlite3_kv_test")
+
+func openTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+	return openTestDriverDB(t, "sqlite3")
+}
+
+// openTestFuncDB opens a database with the kv functions, which use enc
+// once it is created.
+func openTestFuncDB(t *testing.T) *sql.DB {
+	t.Helper()
+	return openTestDriverDB(t, "sqlite3_kv_test")
+}
+
+func openTestDriverDB(t *testing.T, driver string) *sql.DB {
+	t.Helper()
+	db, err := sql.Open(driver, "file:"+filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func testEncoder(t *testing.T, db *sql.DB, opts EncoderOptions) *Encoder {
+	t.Helper()
+	dc, err := NewDictCollection(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc := NewEncoderWithOptions(dc, opts)
+	testFuncs.SetEncoder(enc)
+	return enc
+}
+
+func testKeys() *StaticKeyProvider {
+	return &StaticKeyProvider{
+		Current: 1,
+		Keys:    map[uint16][]byte{1: make([]byte, 32)},
+		Index:   make([]byte, 32),
+	}
+}
+
+func userKeyField() *KeyValField[testUser] {
+	return &KeyValField[testUser]{
+		Name:   "id",
+		Type:   "INTEGER",
+		Get:    func(u *testUser) any { return u.Id },
+		GetPtr: func(u *testUser) any { return &u.Id },
+	}
+}
+
+func emailField() *KeyValField[testUser] {
+	return &KeyValField[testUser]{
+		Name:   "email",
+		Type:   "TEXT",
+		Get:    func(u *testUser) any { return u.Email },
+		GetPtr: func(u *testUser) any { return &u.Email },
+	}
+}
+
+func nameField() *KeyValField[testUser] {
+	return &KeyValField[testUser]{
+		Name:   "name",
+		Type:   "TEXT",
+		Get:    func(u *testUser) any { return u.Name },
+		GetPtr: func(u *testUser) any { return &u.Name },
+	}
+}
@@ -0,0 +1,107 @@
+package sqlitekv
+
+import (
+	"fmt"
+	"strings"
+)
+
+// PathIndex indexes the value at Path, e.g. "$.address.city", through
+// kv_extract. Conditions written with KeyVal.ExtractSQL(Path), or Match
+// keys equal to Path, use the index.
+type PathIndex struct {
+	Path   string `json:"path"`
+	Unique bool   `json:"unique,omitempty"`
+}
+
+func (kv *KeyVal[T]) pathIndexName(path string) string {
+	return kv.tab.Name + "_p_" + strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' {
+			return r
+		}
+		return '_'
+	}, strings.TrimPrefix(path, "$."))
+}
+
+func (kv *KeyVal[T]) pathIndexSql(idx PathIndex) string {
+	unique := ""
+	if idx.Unique {
+		unique = "UNIQUE "
+	}
+	return fmt.Sprintf("CREATE %sINDEX %s ON %s(%s)", unique, kv.pathIndexName(idx.Path),
+		kv.tab.Name, kv.ExtractSQL(idx.Path))
+}
+
+// syncPathIndexes creates the declared path indexes and drops the ones that
+// are no longer declared or whose expression changed.
+func (kv *KeyVal[T]) syncPathIndexes() (err error) {
+	want := make(map[string]string, len(kv.opts.PathIndexes))
+	for _, idx := range kv.opts.PathIndexes {
+		_, err = parseJSONPath(idx.Path)
+		if err != nil {
+			return
+		}
+		name := kv.pathIndexName(idx.Path)
+		if _, ok := want[name]; ok {
+			return fmt.Errorf("path index %s: duplicate index name %s", idx.Path, name)
+		}
+		want[name] = kv.pathIndexSql(idx)
+	}
+
+	if len(want) > 0 {
+		if kv.opts.Encrypt {
+			return fmt.Errorf("path indexes would store plaintext of encrypted values")
+		}
+
+		// Fail early rather than on the first write.
+		_, err = kv.db.Exec(`SELECT kv_extract(NULL, 0, '', '$')`)
+		if err != nil {
+			return fmt.Errorf("path indexes need the kv SQL functions (see RegisterSQLFunctions): %w", err)
+		}
+	}
+
+	// Column indexes can share the prefix; only kv_extract indexes are
+	// path indexes.
+	rows, err := kv.db.Query(`SELECT name, sql FROM sqlite_master WHERE type = 'index' AND tbl_name = ?
+		AND substr(name, 1, ?) = ? AND sql LIKE '%kv_extract(%'`, kv.tab.Name, len(kv.tab.Name)+3, kv.tab.Name+"_p_")
+	if err != nil {
+		return
+	}
+
+	existing := make(map[string]string)
+	for rows.Next() {
+		var name, sql string
+		err = rows.Scan(&name, &sql)
+		if err != nil {
+			rows.Close()
+			return
+		}
+		existing[name] = sql
+	}
+	rows.Close()
+	err = rows.Err()
+	if err != nil {
+		return
+	}
+
+	for name, sql := range existing {
+		if want[name] == sql {
+			continue
+		}
+		_, err = kv.db.Exec(fmt.Sprintf("DROP INDEX %s", name))
+		if err != nil {
+			return
+		}
+		delete(existing, name)
+	}
+
+	for name, sql := range want {
+		if _, ok := existing[name]; ok {
+			continue
+		}
+		_, err = kv.db.Exec(sql)
+		if err != nil {
+			return fmt.Errorf("path index %s: %w", name, err)
+		}
+	}
+	return
+}
@@ -0,0 +1,37 @@
+package sqlitekv
+
+import "testing"
+
+type testItem struct {
+	Id   int64  `json:"id"`
+	Code string `json:"code"`
+	City string `json:"city"`
+}
+
+func TestPathIndexKeepsColumnIndexes(t *testing.T) {
+	db := openTestFuncDB(t)
+	enc := testEncoder(t, db, EncoderOptions{})
+	opts := KeyValOptions[testItem]{
+		KeyField: &KeyValField[testItem]{Name: "id", Type: "INTEGER",
+			Get: func(i *testItem) any { return i.Id }, GetPtr: func(i *testItem) any { return &i.Id }},
+		Fields: []*KeyValField[testItem]{{Name: "p_code", Type: "TEXT", Indexed: true,
+			Get: func(i *testItem) any { return i.Code }, GetPtr: func(i *testItem) any { return &i.Code }}},
+		Enc:         enc,
+		PathIndexes: []PathIndex{{Path: "$.city"}},
+	}
+
+	for range 2 {
+		_, err := NewKeyVal(db, "items", opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, name := range []string{"items_p_code_idx", "items_p_city"} {
+		var n int
+		err := db.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type = 'index' AND name = ?`, name).Scan(&n)
+		if err != nil || n != 1 {
+			t.Errorf("index %s: count %d, %v", name, n, err)
+		}
+	}
+}
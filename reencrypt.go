@@ -0,0 +1,360 @@
+package sqlitekv
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+type ReencryptResult struct {
+	Scanned   int64
+	Rewritten int64
+	Skipped   int64
+}
+
+// Reencrypt rewrites every value that is not encrypted with the current key,
+// batchSize rows per transaction, together with the row's encrypted columns.
+// Rows already on the current key are not selected, so an interrupted run
+// resumes where it stopped when called again. Rows changed concurrently are
+// left alone since they are written with the current key anyway.
+//
+// Values kept in the change log and the history are rewritten too, and
+// counted in the result. Rewriting a row is not a change, so it is neither
+// logged nor a new version.
+func (kv *KeyVal[T]) Reencrypt(ctx context.Context, batchSize int) (res ReencryptResult, err error) {
+	if !kv.opts.Encrypt {
+		err = fmt.Errorf("collection %s is not encrypted", kv.tab.Name)
+		return
+	}
+
+	if batchSize <= 0 {
+		batchSize = 1000
+	}
+
+	curID, _, err := kv.opts.Enc.KeyProvider().CurrentKey()
+	if err != nil {
+		return
+	}
+
+	tables, err := kv.valueTables()
+	if err != nil {
+		return
+	}
+
+	for _, t := range tables {
+		err = kv.reencryptTable(ctx, &res, t, curID, batchSize)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// valueTable is a table holding encoded values of the collection: its own
+// table, the change log or the history.
+type valueTable[T any] struct {
+	name string
+	// key is the column with the primary key the values are bound to.
+	key string
+	// fields are the encrypted columns.
+	fields []*KeyValField[T]
+	// triggers are the triggers on updates of the table that record changes.
+	triggers []string
+}
+
+func (kv *KeyVal[T]) valueTables() (tables []valueTable[T], err error) {
+	changes, hist := kv.ChangeLogTableName(), kv.HistoryTableName()
+	tables = []valueTable[T]{{
+		name:     kv.tab.Name,
+		key:      kv.opts.KeyField.Name,
+		fields:   kv.encryptedFields(),
+		triggers: []string{changes + "_au", hist + "_au"},
+	}}
+
+	// The change log and the history are kept when they are turned off,
+	// values and all.
+	cols, err := tableColumns(kv.db, changes)
+	if err != nil {
+		return
+	}
+	if len(cols) > 0 {
+		tables = append(tables, valueTable[T]{name: changes, key: "key"})
+	}
+
+	cols, err = tableColumns(kv.db, hist)
+	if err != nil {
+		return
+	}
+	if len(cols) > 0 {
+		t := valueTable[T]{name: hist, key: kv.opts.KeyField.Name}
+		for _, f := range kv.encryptedFields() {
+			// Fields added while history was off have no column.
+			if cols[f.Name] {
+				t.fields = append(t.fields, f)
+			}
+		}
+		tables = append(tables, t)
+	}
+	return
+}
+
+func (kv *KeyVal[T]) reencryptTable(ctx context.Context, res *ReencryptResult, t valueTable[T], curID uint16, batchSize int) (err error) {
+	s := strings.Builder{}
+	s.WriteString("SELECT rowid, ")
+	s.WriteString(t.key)
+	s.WriteString(", flags, val")
+	for _, f := range t.fields {
+		s.WriteString(", ")
+		s.WriteString(f.Name)
+	}
+	s.WriteString(" FROM ")
+	s.WriteString(t.name)
+	s.WriteString(" WHERE rowid > ? AND val IS NOT NULL")
+	s.WriteString(fmt.Sprintf(" AND (flags & %d = 0 OR (flags & %d) >> %d != %d)",
+		EncodeFlagEncrypt, KeyIDMask, KeyIDShift, curID))
+	s.WriteString(" ORDER BY rowid LIMIT ?")
+	selectSql := s.String()
+
+	s.Reset()
+	s.WriteString("UPDATE ")
+	s.WriteString(t.name)
+	s.WriteString(" SET flags = ?, val = ?")
+	for _, f := range t.fields {
+		s.WriteString(", ")
+		s.WriteString(f.Name)
+		s.WriteString(" = ?")
+	}
+	s.WriteString(" WHERE rowid = ? AND flags = ? AND val = ?")
+	updateSql := s.String()
+
+	lastRowID := int64(math.MinInt64)
+	for {
+		err = ctx.Err()
+		if err != nil {
+			return
+		}
+
+		var n int
+		n, lastRowID, err = kv.reencryptBatch(ctx, res, t, selectSql, updateSql, lastRowID, batchSize)
+		if err != nil || n < batchSize {
+			return
+		}
+	}
+}
+
+// dropTriggers drops the named triggers that exist and returns the
+// statements that create them again. Dropped in a transaction, they don't
+// fire for its own writes while other connections keep seeing them.
+func dropTriggers(ctx context.Context, tx *sql.Tx, names []string) (recreate []string, err error) {
+	for _, name := range names {
+		var s string
+		err = tx.QueryRowContext(ctx, `SELECT sql FROM sqlite_master WHERE type = 'trigger' AND name = ?`, name).Scan(&s)
+		if err == sql.ErrNoRows {
+			err = nil
+			continue
+		}
+		if err != nil {
+			return
+		}
+
+		_, err = tx.ExecContext(ctx, fmt.Sprintf("DROP TRIGGER %s", name))
+		if err != nil {
+			return
+		}
+		recreate = append(recreate, s)
+	}
+	return
+}
+
+func (kv *KeyVal[T]) encryptedFields() (fields []*KeyValField[T]) {
+	for _, f := range kv.opts.Fields {
+		if f.Encrypted {
+			fields = append(fields, f)
+		}
+	}
+	return
+}
+
+func (kv *KeyVal[T]) reencryptBatch(ctx context.Context, res *ReencryptResult, t valueTable[T],
+	selectSql, updateSql string, afterRowID int64, batchSize int) (n int, lastRowID int64, err error) {
+
+	type encRow struct {
+		rowid int64
+		pkey  any
+		flags int64
+		val   []byte
+		cols  [][]byte
+	}
+
+	lastRowID = afterRowID
+
+	tx, err := kv.db.BeginTx(ctx, nil)
+	if err != nil {
+		return
+	}
+	defer tx.Rollback()
+
+	recreate, err := dropTriggers(ctx, tx, t.triggers)
+	if err != nil {
+		return
+	}
+
+	rows, err := tx.QueryContext(ctx, selectSql, afterRowID, batchSize)
+	if err != nil {
+		return
+	}
+
+	var batch []encRow
+	for rows.Next() {
+		r := encRow{cols: make([][]byte, len(t.fields))}
+		scanArgs := []any{&r.rowid, &r.pkey, &r.flags, &r.val}
+		for i := range t.fields {
+			scanArgs = append(scanArgs, &r.cols[i])
+		}
+
+		err = rows.Scan(scanArgs...)
+		if err != nil {
+			rows.Close()
+			return
+		}
+		batch = append(batch, r)
+	}
+	rows.Close()
+	err = rows.Err()
+	if err != nil {
+		return
+	}
+
+	for _, r := range batch {
+		args := make([]any, 0, len(t.fields)+5)
+
+		var ad []byte
+		ad, err = AssocData(kv.tab.Name, r.pkey)
+		if err != nil {
+			return
+		}
+
+		var flags int64
+		var val []byte
+		flags, val, err = kv.opts.Enc.reencrypt(r.val, r.flags, ad)
+		if err != nil {
+			err = fmt.Errorf("reencrypt %s key %v: %w", t.name, r.pkey, err)
+			return
+		}
+		args = append(args, flags, val)
+
+		for i, f := range t.fields {
+			var col []byte
+			if r.cols[i] != nil {
+				ad, err = kv.fieldAssocData(f, r.pkey)
+				if err != nil {
+					return
+				}
+
+				col, err = kv.opts.Enc.reencryptField(r.cols[i], ad)
+				if err != nil {
+					err = fmt.Errorf("reencrypt %s.%s key %v: %w", t.name, f.Name, r.pkey, err)
+					return
+				}
+			}
+			args = append(args, col)
+		}
+		args = append(args, r.rowid, r.flags, r.val)
+
+		var sqlRes sql.Result
+		sqlRes, err = tx.ExecContext(ctx, updateSql, args...)
+		if err != nil {
+			return
+		}
+
+		var affected int64
+		affected, err = sqlRes.RowsAffected()
+		if err != nil {
+			return
+		}
+
+		res.Scanned++
+		if affected == 0 {
+			res.Skipped++
+		} else {
+			res.Rewritten++
+		}
+		lastRowID = r.rowid
+	}
+
+	for _, s := range recreate {
+		_, err = tx.ExecContext(ctx, s)
+		if err != nil {
+			return
+		}
+	}
+
+	err = tx.Commit()
+	n = len(batch)
+	return
+}
+
+// KeyIDs reports how many values and encrypted columns reference each
+// encryption key id, including values in the change log and the history. A
+// key can be retired once its id no longer appears.
+func (kv *KeyVal[T]) KeyIDs() (counts map[uint16]int64, err error) {
+	counts = make(map[uint16]int64)
+
+	tables, err := kv.valueTables()
+	if err != nil {
+		return
+	}
+
+	for _, t := range tables {
+		err = kv.countKeyIDs(counts, fmt.Sprintf(`SELECT (flags & %d) >> %d, COUNT(*) FROM %s
+			WHERE flags & %d != 0 AND val IS NOT NULL GROUP BY 1`, KeyIDMask, KeyIDShift, t.name, EncodeFlagEncrypt))
+		if err != nil {
+			return
+		}
+
+		for _, f := range t.fields {
+			err = kv.countKeyIDs(counts, fmt.Sprintf(`SELECT hex(substr(%s, 1, 2)), COUNT(*) FROM %s
+				WHERE %s IS NOT NULL GROUP BY 1`, f.Name, t.name, f.Name))
+			if err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+func (kv *KeyVal[T]) countKeyIDs(counts map[uint16]int64, query string) (err error) {
+	rows, err := kv.db.Query(query)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id any
+		var n int64
+		err = rows.Scan(&id, &n)
+		if err != nil {
+			return
+		}
+
+		// Column key ids are read as the hex of their 2 byte prefix.
+		switch id := id.(type) {
+		case int64:
+			counts[uint16(id)] += n
+		case string:
+			var v uint64
+			v, err = strconv.ParseUint(id, 16, 16)
+			if err != nil {
+				return
+			}
+			counts[uint16(v)] += n
+		}
+	}
+
+	err = rows.Err()
+	return
+}
@@ -0,0 +1,141 @@
+package sqlitekv
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+	"testing"
+)
+
+func TestReencrypt(t *testing.T) {
+	email := emailField()
+	email.Encrypted = true
+	kv := openEncryptedUsers(t, KeyValOptions[testUser]{Fields: []*KeyValField[testUser]{email}})
+	for i := range 3 {
+		err := kv.Upsert(&testUser{Id: int64(i + 1), Name: fmt.Sprint("user ", i+1), Email: fmt.Sprintf("u%d@example.com", i+1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	checkKeyIDs := func(want map[uint16]int64) {
+		t.Helper()
+		got, err := kv.KeyIDs()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !maps.Equal(got, want) {
+			t.Errorf("KeyIDs = %v, want %v", got, want)
+		}
+	}
+	checkKeyIDs(map[uint16]int64{1: 6})
+
+	keys := kv.opts.Enc.KeyProvider().(*StaticKeyProvider)
+	keys.Keys[2] = bytes.Repeat([]byte{2}, 32)
+	keys.Current = 2
+
+	res, err := kv.Reencrypt(context.Background(), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res != (ReencryptResult{Scanned: 3, Rewritten: 3}) {
+		t.Errorf("Reencrypt = %+v", res)
+	}
+	checkKeyIDs(map[uint16]int64{2: 6})
+
+	delete(keys.Keys, 1)
+	var u testUser
+	ok, err := kv.Get(2, &u)
+	if err != nil || !ok || u.Email != "u2@example.com" {
+		t.Errorf("Get = %+v, %v, %v", u, ok, err)
+	}
+
+	res, err = kv.Reencrypt(context.Background(), 2)
+	if err != nil || res != (ReencryptResult{}) {
+		t.Errorf("second Reencrypt = %+v, %v", res, err)
+	}
+}
+
+func TestReencryptChangeLog(t *testing.T) {
+	kv := openEncryptedUsers(t, KeyValOptions[testUser]{ChangeLog: &ChangeLogOptions{IncludeValue: true}})
+	for _, u := range []*testUser{{Id: 1, Name: "alice"}, {Id: 2, Name: "bob"}} {
+		err := kv.Upsert(u)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err := kv.Delete(int64(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys := kv.opts.Enc.KeyProvider().(*StaticKeyProvider)
+	keys.Keys[2] = bytes.Repeat([]byte{2}, 32)
+	keys.Current = 2
+
+	res, err := kv.Reencrypt(context.Background(), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res != (ReencryptResult{Scanned: 3, Rewritten: 3}) {
+		t.Errorf("Reencrypt = %+v", res)
+	}
+	ids, err := kv.KeyIDs()
+	if err != nil || !maps.Equal(ids, map[uint16]int64{2: 3}) {
+		t.Errorf("KeyIDs = %v, %v", ids, err)
+	}
+
+	delete(keys.Keys, 1)
+	var ops []ChangeOp
+	for c, err := range kv.Changes(0) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		ops = append(ops, c.Op)
+		if c.Op == OpInsert && c.Value == nil {
+			t.Errorf("change %d has no value", c.Seq)
+		}
+	}
+	if !slices.Equal(ops, []ChangeOp{OpInsert, OpInsert, OpDelete}) {
+		t.Errorf("change log = %v", ops)
+	}
+}
+
+func TestReencryptHistory(t *testing.T) {
+	email := emailField()
+	email.Encrypted = true
+	kv := openEncryptedUsers(t, KeyValOptions[testUser]{Fields: []*KeyValField[testUser]{email}, KeepHistory: true})
+	for _, u := range []*testUser{{Id: 1, Name: "alice", Email: "a@example.com"}, {Id: 1, Name: "alice", Email: "b@example.com"}} {
+		err := kv.Upsert(u)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	keys := kv.opts.Enc.KeyProvider().(*StaticKeyProvider)
+	keys.Keys[2] = bytes.Repeat([]byte{2}, 32)
+	keys.Current = 2
+
+	res, err := kv.Reencrypt(context.Background(), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res != (ReencryptResult{Scanned: 3, Rewritten: 3}) {
+		t.Errorf("Reencrypt = %+v", res)
+	}
+	ids, err := kv.KeyIDs()
+	if err != nil || !maps.Equal(ids, map[uint16]int64{2: 6}) {
+		t.Errorf("KeyIDs = %v, %v", ids, err)
+	}
+
+	delete(keys.Keys, 1)
+	list, err := kv.History(int64(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 || list[0].Value.Email != "a@example.com" || list[1].Value.Email != "b@example.com" {
+		t.Errorf("History has %d versions", len(list))
+	}
+}
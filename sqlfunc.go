@@ -0,0 +1,212 @@
+package sqlitekv
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// SQLFunctions registers kv_decode and kv_extract on every connection of a
+// sqlite3 driver:
+//
+//	kv_decode(val, flags, dictkey [, table, pkey])
+//	kv_extract(val, flags, dictkey, '$.path' [, table, pkey])
+//
+// kv_decode returns the value as JSON. kv_extract returns the value at a
+// JSON path, as JSON when it is an object or array. table and pkey are only
+// needed for encrypted values. The encoder can be set after the database
+// is opened, since it usually depends on it.
+type SQLFunctions struct {
+	enc atomic.Pointer[Encoder]
+}
+
+// RegisterSQLFunctions registers a sqlite3 driver named driverName whose
+// connections have the kv functions. Open the database with that name.
+func RegisterSQLFunctions(driverName string) *SQLFunctions {
+	f := &SQLFunctions{}
+	sql.Register(driverName, &sqlite3.SQLiteDriver{
+		ConnectHook: f.Register,
+	})
+	return f
+}
+
+func (f *SQLFunctions) SetEncoder(enc *Encoder) {
+	f.enc.Store(enc)
+}
+
+// Register adds the functions to conn, for use in a custom ConnectHook.
+func (f *SQLFunctions) Register(conn *sqlite3.SQLiteConn) (err error) {
+	err = conn.RegisterFunc("kv_decode", f.decode, true)
+	if err != nil {
+		return
+	}
+	return conn.RegisterFunc("kv_extract", f.extract, true)
+}
+
+func (f *SQLFunctions) value(val []byte, flags int64, dictKey string, extra []any) (v any, err error) {
+	enc := f.enc.Load()
+	if enc == nil {
+		err = fmt.Errorf("kv functions: encoder is not set")
+		return
+	}
+
+	opts := DecodeOptions{DictKey: dictKey}
+	switch len(extra) {
+	case 0:
+	case 2:
+		table, ok := extra[0].(string)
+		if !ok {
+			err = fmt.Errorf("kv functions: table must be text")
+			return
+		}
+		opts.PKey = extra[1]
+		if s, ok := opts.PKey.([]byte); ok && s == nil {
+			opts.PKey = nil
+		}
+		if IsEncrypted(flags) {
+			opts.AssocData, err = AssocData(table, opts.PKey)
+			if err != nil {
+				return
+			}
+		}
+	default:
+		err = fmt.Errorf("kv functions: expected table and pkey after the fixed arguments")
+		return
+	}
+
+	buf, err := enc.DecodeBuf(val, flags, opts)
+	if err != nil {
+		return
+	}
+
+	err = untypedDecMode.Unmarshal(buf, &v)
+	return
+}
+
+// valueBytes returns the bytes of a val argument; NULL gives nil.
+func valueBytes(val any) ([]byte, error) {
+	switch v := val.(type) {
+	case nil:
+		return nil, nil
+	case []byte:
+		return v, nil
+	case string:
+		return []byte(v), nil
+	}
+	return nil, fmt.Errorf("kv functions: val must be a BLOB, got %T", val)
+}
+
+func (f *SQLFunctions) decode(arg any, flags int64, dictKey string, extra ...any) (any, error) {
+	val, err := valueBytes(arg)
+	if err != nil || val == nil {
+		return nil, err
+	}
+
+	v, err := f.value(val, flags, dictKey, extra)
+	if err != nil {
+		return nil, err
+	}
+	return toJSON(v)
+}
+
+func (f *SQLFunctions) extract(arg any, flags int64, dictKey string, path string, extra ...any) (any, error) {
+	val, err := valueBytes(arg)
+	if err != nil || val == nil {
+		return nil, err
+	}
+
+	docPath, err := parseJSONPath(path)
+	if err != nil {
+		return nil, err
+	}
+
+	v, err := f.value(val, flags, dictKey, extra)
+	if err != nil {
+		return nil, err
+	}
+
+	if docPath != "" {
+		doc, ok := v.(map[string]any)
+		if !ok {
+			return nil, nil
+		}
+		v, _ = DocumentPath(doc, docPath)
+	}
+	return sqlValue(v)
+}
+
+// parseJSONPath converts a path such as $.address.city or $.tags[0] into
+// the dotted form used by DocumentPath.
+func parseJSONPath(path string) (string, error) {
+	if !strings.HasPrefix(path, "$") {
+		return "", fmt.Errorf("invalid path %q: must start with $", path)
+	}
+
+	p := strings.ReplaceAll(path[1:], "[", ".")
+	p = strings.ReplaceAll(p, "]", "")
+	p = strings.TrimPrefix(p, ".")
+	if strings.Contains(p, "..") || strings.HasSuffix(p, ".") {
+		return "", fmt.Errorf("invalid path %q", path)
+	}
+	return p, nil
+}
+
+// sqlValue maps a decoded value to a SQLite value. Objects and arrays are
+// returned as JSON.
+func sqlValue(v any) (any, error) {
+	switch v := v.(type) {
+	case nil, string, []byte, int64, float64:
+		return v, nil
+	case bool:
+		if v {
+			return int64(1), nil
+		}
+		return int64(0), nil
+	case uint64:
+		if v > 1<<63-1 {
+			return strconv.FormatUint(v, 10), nil
+		}
+		return int64(v), nil
+	case float32:
+		return float64(v), nil
+	case map[string]any, []any:
+		return toJSON(v)
+	}
+	return fmt.Sprint(v), nil
+}
+
+func toJSON(v any) (any, error) {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return string(buf), nil
+}
+
+// DecodeSQL returns a kv_decode call for this collection's rows, for use in
+// Where clauses and views.
+func (kv *KeyVal[T]) DecodeSQL() string {
+	return fmt.Sprintf("kv_decode(val, flags, %s%s)", sqlQuote(kv.dictKey), kv.sqlFuncKeyArgs())
+}
+
+// ExtractSQL returns a kv_extract call for path, e.g. "$.address.city".
+func (kv *KeyVal[T]) ExtractSQL(path string) string {
+	return fmt.Sprintf("kv_extract(val, flags, %s, %s%s)", sqlQuote(kv.dictKey), sqlQuote(path), kv.sqlFuncKeyArgs())
+}
+
+func (kv *KeyVal[T]) sqlFuncKeyArgs() string {
+	if !kv.opts.Encrypt {
+		return ""
+	}
+	return fmt.Sprintf(", %s, %s", sqlQuote(kv.tab.Name), kv.opts.KeyField.Name)
+}
+
+// sqlQuote returns s as an SQL string literal.
+func sqlQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
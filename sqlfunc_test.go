@@ -0,0 +1,35 @@
+package sqlitekv
+
+import "testing"
+
+func TestSQLFunctionsQuoteDictKey(t *testing.T) {
+	db := openTestFuncDB(t)
+	enc := testEncoder(t, db, EncoderOptions{})
+	kv, err := NewKeyVal(db, "users", KeyValOptions[testUser]{
+		KeyField:    userKeyField(),
+		Enc:         enc,
+		Compression: true,
+		DictKey:     "o'brien",
+		JSONView:    true,
+		PathIndexes: []PathIndex{{Path: "$.name"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = kv.Upsert(&testUser{Id: 1, Name: "a'b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var name string
+	err = db.QueryRow("SELECT doc ->> 'name' FROM users_json WHERE id = 1").Scan(&name)
+	if err != nil || name != "a'b" {
+		t.Fatalf("view name = %q, %v", name, err)
+	}
+
+	list, err := kv.Select(nil, SelectOptions[testUser]{Match: map[string]any{"$.name": "a'b"}})
+	if err != nil || len(list) != 1 {
+		t.Fatalf("select = %v, %v", list, err)
+	}
+}
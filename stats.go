@@ -0,0 +1,65 @@
+package sqlitekv
+
+import (
+	"context"
+	"fmt"
+)
+
+type CollectionStats struct {
+	Rows        int64
+	Deleted     int64
+	StoredBytes int64
+	// RawBytes is the size of the CBOR payloads before compression and
+	// encryption.
+	RawBytes int64
+	Ratio    float64
+}
+
+// Stats decodes every row to measure the collection's compression ratio.
+func (kv *KeyVal[T]) Stats(ctx context.Context) (stats CollectionStats, err error) {
+	rows, err := kv.db.QueryContext(ctx, fmt.Sprintf("SELECT %s, flags, val FROM %s",
+		kv.opts.KeyField.Name, kv.tab.Name))
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var pkey any
+		var flags int64
+		var val []byte
+		err = rows.Scan(&pkey, &flags, &val)
+		if err != nil {
+			return
+		}
+
+		var opts DecodeOptions
+		opts, err = kv.decodeOptions(flags, pkey)
+		if err != nil {
+			return
+		}
+
+		var buf []byte
+		buf, err = kv.opts.Enc.DecodeBuf(val, flags, opts)
+		if err != nil {
+			return
+		}
+
+		stats.Rows++
+		if flags&EncodeSoftDelete != 0 {
+			stats.Deleted++
+		}
+		stats.StoredBytes += int64(len(val))
+		stats.RawBytes += int64(len(buf))
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return
+	}
+
+	if stats.StoredBytes > 0 {
+		stats.Ratio = float64(stats.RawBytes) / float64(stats.StoredBytes)
+	}
+	return
+}
@@ -17,6 +17,9 @@ type TableField struct {
 
 type TableOptions struct {
 	Fields []TableField
+	// Existing opens a table that must already exist instead of creating
+	// it and its indexes.
+	Existing bool
 }
 
 type Table struct {
@@ -34,6 +37,11 @@ func NewTable(db *sql.DB, name string, opts TableOptions) (t *Table, err error)
 		stmtStore: NewStmtStore(),
 	}
 
+	if opts.Existing {
+		err = t.checkExists()
+		return
+	}
+
 	err = t.init()
 	if err != nil {
 		return
@@ -42,6 +50,15 @@ func NewTable(db *sql.DB, name string, opts TableOptions) (t *Table, err error)
 	return
 }
 
+func (t *Table) checkExists() (err error) {
+	var n int
+	err = t.db.QueryRow(`SELECT COUNT(*) FROM sqlite_schema WHERE type = 'table' AND name = ?`, t.Name).Scan(&n)
+	if err == nil && n == 0 {
+		err = fmt.Errorf("table %s does not exist", t.Name)
+	}
+	return
+}
+
 func (t *Table) init() (err error) {
 	err = t.createTable()
 	if err != nil {
@@ -125,8 +142,8 @@ func (t *Table) Row(stmtName string, getSql func() string, bindargs []any, args
 	return
 }
 
-func (t *Table) Insert(args ...any) (rid int64, err error) {
-	stmt, err := t.stmtStore.GetOrCreate(t.db, "insert", func() string {
+func (t *Table) insertStmt() (*sql.Stmt, error) {
+	return t.stmtStore.GetOrCreate(t.db, "insert", func() string {
 		s := strings.Builder{}
 		s.WriteString("INSERT INTO ")
 		s.WriteString(t.Name)
@@ -150,6 +167,10 @@ func (t *Table) Insert(args ...any) (rid int64, err error) {
 
 		return s.String()
 	})
+}
+
+func (t *Table) Insert(args ...any) (rid int64, err error) {
+	stmt, err := t.insertStmt()
 	if err != nil {
 		return
 	}
@@ -163,8 +184,8 @@ func (t *Table) Insert(args ...any) (rid int64, err error) {
 	return
 }
 
-func (t *Table) Upsert(args ...any) (rid int64, err error) {
-	stmt, err := t.stmtStore.GetOrCreate(t.db, "upsert", func() string {
+func (t *Table) upsertStmt() (*sql.Stmt, error) {
+	return t.stmtStore.GetOrCreate(t.db, "upsert", func() string {
 		s := strings.Builder{}
 		s.WriteString("INSERT INTO ")
 		s.WriteString(t.Name)
@@ -216,6 +237,10 @@ func (t *Table) Upsert(args ...any) (rid int64, err error) {
 
 		return s.String()
 	})
+}
+
+func (t *Table) Upsert(args ...any) (rid int64, err error) {
+	stmt, err := t.upsertStmt()
 	if err != nil {
 		return
 	}
@@ -229,6 +254,32 @@ func (t *Table) Upsert(args ...any) (rid int64, err error) {
 	return
 }
 
+// UpsertMany upserts all rows in a single transaction.
+func (t *Table) UpsertMany(rows [][]any) (err error) {
+	stmt, err := t.upsertStmt()
+	if err != nil {
+		return
+	}
+
+	tx, err := t.db.Begin()
+	if err != nil {
+		return
+	}
+	defer tx.Rollback()
+
+	txStmt := tx.Stmt(stmt)
+	defer txStmt.Close()
+
+	for _, args := range rows {
+		_, err = txStmt.Exec(args...)
+		if err != nil {
+			return
+		}
+	}
+
+	return tx.Commit()
+}
+
 func (t *Table) Update(updateSql string, args ...any) (affectedCount int64, err error) {
 	res, err := t.db.Exec(updateSql, args...)
 	if err != nil {
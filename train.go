@@ -0,0 +1,169 @@
+package sqlitekv
+
+import (
+	"fmt"
+	"strings"
+)
+
+const DefaultDictSize = 112640
+
+type TrainStrategy int
+
+const (
+	// TrainFirst samples rows in rowid order, oldest first.
+	TrainFirst TrainStrategy = iota
+	TrainRandom
+	TrainRecent
+	// TrainStratified samples an equal share of random rows for every
+	// distinct value of TrainOptions.StratifyField.
+	TrainStratified
+)
+
+type TrainOptions struct {
+	Strategy      TrainStrategy
+	Limit         int
+	StratifyField string
+	DictSize      int
+	MinSamples    int
+	DryRun        bool
+}
+
+type TrainResult struct {
+	Dict                 Dict
+	Samples              int
+	SampleBytes          int64
+	CompressedBytes      int64
+	PlainCompressedBytes int64
+	Ratio                float64
+	PlainRatio           float64
+}
+
+func (kv *KeyVal[T]) trainSql(opts TrainOptions) (selectSql string, err error) {
+	if opts.Limit <= 0 {
+		err = fmt.Errorf("train limit must be positive")
+		return
+	}
+
+	switch opts.Strategy {
+	case TrainFirst:
+		selectSql = fmt.Sprintf("SELECT %s, flags, val FROM %s WHERE flags & 1 = 0 ORDER BY rowid LIMIT %d",
+			kv.opts.KeyField.Name, kv.tab.Name, opts.Limit)
+	case TrainRecent:
+		selectSql = fmt.Sprintf("SELECT %s, flags, val FROM %s WHERE flags & 1 = 0 ORDER BY rowid DESC LIMIT %d",
+			kv.opts.KeyField.Name, kv.tab.Name, opts.Limit)
+	case TrainRandom:
+		selectSql = fmt.Sprintf("SELECT %s, flags, val FROM %s WHERE flags & 1 = 0 ORDER BY random() LIMIT %d",
+			kv.opts.KeyField.Name, kv.tab.Name, opts.Limit)
+	case TrainStratified:
+		selectSql, err = kv.stratifiedSql(opts)
+	default:
+		err = fmt.Errorf("unknown train strategy: %d", opts.Strategy)
+	}
+	return
+}
+
+func (kv *KeyVal[T]) stratifiedSql(opts TrainOptions) (selectSql string, err error) {
+	if !kv.hasColumn(opts.StratifyField) {
+		err = fmt.Errorf("unknown stratify field: %q", opts.StratifyField)
+		return
+	}
+
+	var strata int64
+	row := kv.db.QueryRow(fmt.Sprintf("SELECT COUNT(DISTINCT %s) FROM %s WHERE flags & 1 = 0",
+		opts.StratifyField, kv.tab.Name))
+	err = row.Scan(&strata)
+	if err != nil {
+		return
+	}
+
+	perStratum := int64(opts.Limit)
+	if strata > 1 {
+		perStratum = (perStratum + strata - 1) / strata
+	}
+
+	s := strings.Builder{}
+	s.WriteString("SELECT pkey, flags, val FROM (SELECT ")
+	s.WriteString(kv.opts.KeyField.Name)
+	s.WriteString(" AS pkey, flags, val, ROW_NUMBER() OVER (PARTITION BY ")
+	s.WriteString(opts.StratifyField)
+	s.WriteString(" ORDER BY random()) AS rn FROM ")
+	s.WriteString(kv.tab.Name)
+	s.WriteString(" WHERE flags & 1 = 0)")
+	s.WriteString(fmt.Sprintf(" WHERE rn <= %d ORDER BY random() LIMIT %d", perStratum, opts.Limit))
+	selectSql = s.String()
+	return
+}
+
+func (kv *KeyVal[T]) hasColumn(name string) bool {
+	if name == "" {
+		return false
+	}
+	if name == kv.opts.KeyField.Name {
+		return true
+	}
+	for _, f := range kv.opts.Fields {
+		if f.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// trainSamples reads (key, flags, val) rows and returns their CBOR payloads.
+func (kv *KeyVal[T]) trainSamples(selectSql string) (samples [][]byte, err error) {
+	rows, err := kv.db.Query(selectSql)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var pkey any
+		var flags int64
+		var val []byte
+		err = rows.Scan(&pkey, &flags, &val)
+		if err != nil {
+			return
+		}
+
+		var opts DecodeOptions
+		opts, err = kv.decodeOptions(flags, pkey)
+		if err != nil {
+			return
+		}
+
+		var buf []byte
+		buf, err = kv.opts.Enc.DecodeBuf(val, flags, opts)
+		if err != nil {
+			return
+		}
+
+		samples = append(samples, buf)
+	}
+
+	err = rows.Err()
+	return
+}
+
+func (kv *KeyVal[T]) TrainWithOptions(opts TrainOptions) (res TrainResult, err error) {
+	selectSql, err := kv.trainSql(opts)
+	if err != nil {
+		return
+	}
+
+	samples, err := kv.trainSamples(selectSql)
+	if err != nil {
+		return
+	}
+
+	res, err = kv.opts.Enc.TrainSamples(kv.dictKey, samples, opts)
+	if err != nil || opts.DryRun {
+		return
+	}
+
+	kv.latestDictVer = res.Dict.Ver
+	kv.encodeOpt.DictVer = res.Dict.Ver
+	kv.encodeOpt.UseDict = kv.opts.Compression && kv.opts.UseDict
+
+	return
+}
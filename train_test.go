@@ -0,0 +1,89 @@
+package sqlitekv
+
+import (
+	"fmt"
+	"testing"
+)
+
+func trainUsers(t *testing.T, n int) *KeyVal[testUser] {
+	t.Helper()
+	db := openTestDB(t)
+	kv, err := NewKeyVal(db, "users", KeyValOptions[testUser]{
+		KeyField:    userKeyField(),
+		Fields:      []*KeyValField[testUser]{nameField()},
+		Enc:         testEncoder(t, db, EncoderOptions{}),
+		Compression: true,
+		UseDict:     true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	objs := make([]*testUser, n)
+	for i := range objs {
+		objs[i] = &testUser{Id: int64(i + 1), Name: fmt.Sprintf("org%d", i%5),
+			Email: fmt.Sprintf("user%d@example.com", i)}
+	}
+	err = kv.UpsertBatch(objs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return kv
+}
+
+func TestTrainDryRun(t *testing.T) {
+	kv := trainUsers(t, 500)
+	res, err := kv.TrainWithOptions(TrainOptions{Strategy: TrainStratified, StratifyField: "name",
+		Limit: 100, DictSize: 4096, DryRun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Samples != 100 || res.Ratio <= 0 || res.PlainRatio <= 0 {
+		t.Errorf("result = %+v", res)
+	}
+
+	ver, err := kv.opts.Enc.DictCollection().GetMaxVersion(kv.DictKey())
+	if err != nil || ver != 0 {
+		t.Errorf("dry run stored dictionary %d, %v", ver, err)
+	}
+}
+
+func TestTrainStrategies(t *testing.T) {
+	kv := trainUsers(t, 500)
+	for _, opts := range []TrainOptions{
+		{Strategy: TrainFirst, Limit: 10, MinSamples: 50},
+		{Strategy: TrainStratified, StratifyField: "missing", Limit: 10},
+		{Strategy: TrainRandom},
+	} {
+		_, err := kv.TrainWithOptions(opts)
+		if err == nil {
+			t.Errorf("TrainWithOptions(%+v) succeeded", opts)
+		}
+	}
+
+	for i, s := range []TrainStrategy{TrainFirst, TrainRandom, TrainRecent, TrainStratified} {
+		res, err := kv.TrainWithOptions(TrainOptions{Strategy: s, StratifyField: "name", Limit: 200, DictSize: 4096})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.Dict.Ver != uint32(i+1) {
+			t.Errorf("strategy %d: version %d", s, res.Dict.Ver)
+		}
+	}
+
+	err := kv.Upsert(&testUser{Id: 1, Name: "org1", Email: "new@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var flags int64
+	err = kv.db.QueryRow("SELECT flags FROM users WHERE id = 1").Scan(&flags)
+	if err != nil || !IsDictCompressed(flags) || DictVerFromFlags(flags) != 4 {
+		t.Errorf("flags = %x, %v", flags, err)
+	}
+
+	var u testUser
+	ok, err := kv.Get(1, &u)
+	if err != nil || !ok || u.Email != "new@example.com" {
+		t.Errorf("Get = %+v, %v, %v", u, ok, err)
+	}
+}
@@ -0,0 +1,162 @@
+package sqlitekv
+
+import (
+	"database/sql"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+var untypedDecMode, _ = cbor.DecOptions{
+	DefaultMapType: reflect.TypeOf(map[string]any(nil)),
+}.DecMode()
+
+// OpenCollection opens a collection registered in the catalog as
+// documents, e.g. for tools that don't have its Go type. Columns are read
+// from the document paths recorded in the catalog, and documents are
+// validated as in NewDocumentCollection.
+func OpenCollection(db *sql.DB, enc *Encoder, name string) (kv *KeyVal[Document], err error) {
+	return openCollection(db, enc, name, false)
+}
+
+// OpenCollectionReadOnly is OpenCollection with KeyValOptions.ReadOnly, so
+// opening leaves the database unchanged.
+func OpenCollectionReadOnly(db *sql.DB, enc *Encoder, name string) (kv *KeyVal[Document], err error) {
+	return openCollection(db, enc, name, true)
+}
+
+func openCollection(db *sql.DB, enc *Encoder, name string, readOnly bool) (kv *KeyVal[Document], err error) {
+	cat := &Catalog{db: db}
+	if !readOnly {
+		err = cat.init()
+		if err != nil {
+			return
+		}
+	}
+
+	ok, spec, err := cat.Get(name)
+	if err != nil {
+		return
+	}
+	if !ok {
+		err = fmt.Errorf("collection %s not found in catalog", name)
+		return
+	}
+
+	opts := KeyValOptions[Document]{
+		KeyField:    documentField(spec.Key),
+		Enc:         enc,
+		Compression: spec.Compression,
+		UseDict:     spec.UseDict,
+		DictKey:     spec.DictKey,
+		Encrypt:     spec.Encrypt,
+		Checksum:    spec.Checksum,
+		JSONView:    spec.JSONView,
+		PathIndexes: spec.PathIndexes,
+		VectorIndex: spec.VectorIndex,
+		ChangeLog:   spec.ChangeLog,
+		KeepHistory: spec.KeepHistory,
+		Audit:       spec.Audit,
+		ReadOnly:    readOnly,
+	}
+	for _, f := range spec.Fields {
+		opts.Fields = append(opts.Fields, documentField(f))
+	}
+	opts.Validate = func(doc *Document) error {
+		return validateDocument(opts, doc)
+	}
+
+	return NewKeyVal(db, name, opts)
+}
+
+// Coerce converts v to the Go type SQLite stores for the column type
+// sqlType, following SQLite's type affinity rules. nil stays nil.
+func Coerce(v any, sqlType string) (any, error) {
+	if v == nil {
+		return nil, nil
+	}
+
+	t := strings.ToUpper(sqlType)
+	switch {
+	case strings.Contains(t, "INT"):
+		return coerceInt(v)
+	case strings.Contains(t, "CHAR"), strings.Contains(t, "CLOB"), strings.Contains(t, "TEXT"):
+		return coerceText(v)
+	case strings.Contains(t, "BLOB"), t == "":
+		return v, nil
+	case strings.Contains(t, "REAL"), strings.Contains(t, "FLOA"), strings.Contains(t, "DOUB"):
+		return coerceReal(v)
+	}
+	return coerceNumeric(v)
+}
+
+func coerceInt(v any) (any, error) {
+	switch n := v.(type) {
+	case string:
+		return strconv.ParseInt(n, 10, 64)
+	case bool:
+		if n {
+			return int64(1), nil
+		}
+		return int64(0), nil
+	}
+
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return rv.Int(), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return int64(rv.Uint()), nil
+	case reflect.Float32, reflect.Float64:
+		f := rv.Float()
+		if f != float64(int64(f)) {
+			return nil, fmt.Errorf("%v is not an integer", v)
+		}
+		return int64(f), nil
+	}
+	return nil, fmt.Errorf("cannot convert %T to integer", v)
+}
+
+func coerceReal(v any) (any, error) {
+	if s, ok := v.(string); ok {
+		return strconv.ParseFloat(s, 64)
+	}
+
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(rv.Int()), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(rv.Uint()), nil
+	case reflect.Float32, reflect.Float64:
+		return rv.Float(), nil
+	}
+	return nil, fmt.Errorf("cannot convert %T to real", v)
+}
+
+func coerceText(v any) (any, error) {
+	switch s := v.(type) {
+	case string:
+		return s, nil
+	case []byte:
+		return string(s), nil
+	case map[string]any, []any:
+		return nil, fmt.Errorf("cannot convert %T to text", v)
+	}
+	return fmt.Sprint(v), nil
+}
+
+// coerceNumeric follows NUMERIC affinity: integral values become integers,
+// other numbers reals, and anything else is kept.
+func coerceNumeric(v any) (any, error) {
+	if n, err := coerceInt(v); err == nil {
+		return n, nil
+	}
+	if f, err := coerceReal(v); err == nil {
+		return f, nil
+	}
+	return v, nil
+}
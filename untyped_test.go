@@ -0,0 +1,111 @@
+package sqlitekv
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+)
+
+func TestOpenTypedCollectionUntyped(t *testing.T) {
+	db := openTestDB(t)
+	enc := testEncoder(t, db, EncoderOptions{})
+	mail := emailField()
+	mail.Name = "mail"
+	mail.Indexed = true
+	users, err := NewKeyVal(db, "users", KeyValOptions[testUser]{
+		KeyField: userKeyField(),
+		Fields:   []*KeyValField[testUser]{mail},
+		Enc:      enc,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = users.Upsert(&testUser{Id: 1, Name: "alice", Email: "a@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	docs, err := OpenCollection(db, enc, "users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path := docs.Spec().Fields[0].Path; path != "email" {
+		t.Errorf("mail path = %q", path)
+	}
+
+	var doc Document
+	ok, err := docs.Get(int64(1), &doc)
+	if err != nil || !ok || doc["email"] != "a@example.com" {
+		t.Fatalf("Get = %v, %v, %v", doc, ok, err)
+	}
+
+	err = docs.Upsert(&Document{"id": 2, "name": "bob", "email": "b@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mailCol string
+	err = db.QueryRow("SELECT mail FROM users WHERE id = 2").Scan(&mailCol)
+	if err != nil || mailCol != "b@example.com" {
+		t.Errorf("mail column = %q, %v", mailCol, err)
+	}
+
+	var u testUser
+	ok, err = users.Get(int64(2), &u)
+	if err != nil || !ok || u.Email != "b@example.com" {
+		t.Errorf("typed Get = %+v, %v, %v", u, ok, err)
+	}
+
+	report, err := docs.Verify(context.Background())
+	if err != nil || !report.OK() {
+		t.Errorf("Verify = %+v, %v", report, err)
+	}
+}
+
+func TestOpenCollectionReadOnly(t *testing.T) {
+	db := openTestDB(t)
+	enc := testEncoder(t, db, EncoderOptions{})
+	users, err := NewKeyVal(db, "users", KeyValOptions[testUser]{
+		KeyField: userKeyField(),
+		Fields:   []*KeyValField[testUser]{emailField()},
+		Enc:      enc,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = users.Upsert(&testUser{Id: 1, Name: "alice", Email: "a@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var path string
+	err = db.QueryRow("SELECT file FROM pragma_database_list WHERE name = 'main'").Scan(&path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roDB, err := sql.Open("sqlite3", "file:"+path+"?mode=ro")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer roDB.Close()
+	roEnc := testEncoder(t, roDB, EncoderOptions{})
+
+	_, err = OpenCollection(roDB, roEnc, "users")
+	if err == nil {
+		t.Error("OpenCollection wrote to a read-only database")
+	}
+
+	docs, err := OpenCollectionReadOnly(roDB, roEnc, "users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var doc Document
+	ok, err := docs.Get(int64(1), &doc)
+	if err != nil || !ok || doc["name"] != "alice" {
+		t.Errorf("Get = %v, %v, %v", doc, ok, err)
+	}
+
+	_, err = OpenCollectionReadOnly(roDB, roEnc, "missing")
+	if err == nil {
+		t.Error("opened a collection that is not in the catalog")
+	}
+}
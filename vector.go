@@ -0,0 +1,482 @@
+package sqlitekv
+
+import (
+	"container/heap"
+	"database/sql"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+)
+
+type VectorMetric int
+
+const (
+	Cosine VectorMetric = iota
+	DotProduct
+)
+
+// VectorIndexOptions configure the IVF index: vectors are clustered into
+// Lists lists around k-means centroids, and a query scans the vectors of
+// the Probes lists whose centroids are most similar. The defaults are
+// sqrt(rows) lists, 8 probes and 10 k-means iterations.
+//
+// The index is built when the collection is opened and by
+// RebuildVectorIndex. Rows written through the collection later are added
+// to the list of their nearest centroid, and stay in the lists of their
+// older vectors until the next rebuild. Rows written by other means, e.g. in
+// SQL, are only found when their rowid is above the largest at build time.
+type VectorIndexOptions struct {
+	Lists      int `json:"lists,omitempty"`
+	Probes     int `json:"probes,omitempty"`
+	Iterations int `json:"iterations,omitempty"`
+}
+
+// VectorFilter restricts SimilarTo to rows matching Where.
+type VectorFilter struct {
+	Where string
+	Args  []any
+}
+
+type VectorResult[T any] struct {
+	Obj   *T
+	Score float64
+}
+
+func vectorColumnValue(v any, dims int) (any, error) {
+	vec, err := toVector(v)
+	if err != nil {
+		return nil, err
+	}
+	if vec == nil {
+		return nil, nil
+	}
+	if len(vec) != dims {
+		return nil, fmt.Errorf("vector has %d dimensions, expected %d", len(vec), dims)
+	}
+	return encodeVector(vec), nil
+}
+
+func toVector(v any) (vec []float32, err error) {
+	switch x := v.(type) {
+	case []float32:
+		return x, nil
+	case []float64:
+		vec = make([]float32, len(x))
+		for i, f := range x {
+			vec[i] = float32(f)
+		}
+		return
+	case []any:
+		vec = make([]float32, len(x))
+		for i, e := range x {
+			var f float64
+			f, err = geoNumber(e)
+			if err != nil {
+				return nil, fmt.Errorf("vector element %d: %w", i, err)
+			}
+			vec[i] = float32(f)
+		}
+		return
+	}
+
+	if rv := reflect.ValueOf(v); rv.Kind() == reflect.Slice && rv.IsNil() {
+		return nil, nil
+	}
+	return nil, fmt.Errorf("cannot convert %T to a vector", v)
+}
+
+func encodeVector(vec []float32) []byte {
+	buf := make([]byte, 4*len(vec))
+	for i, f := range vec {
+		binary.LittleEndian.PutUint32(buf[4*i:], math.Float32bits(f))
+	}
+	return buf
+}
+
+func decodeVector(buf []byte, dims int) ([]float32, error) {
+	if len(buf) != 4*dims {
+		return nil, fmt.Errorf("vector blob has %d bytes, expected %d", len(buf), 4*dims)
+	}
+	vec := make([]float32, dims)
+	for i := range vec {
+		vec[i] = math.Float32frombits(binary.LittleEndian.Uint32(buf[4*i:]))
+	}
+	return vec, nil
+}
+
+func dot(a, b []float32) (s float64) {
+	for i := range a {
+		s += float64(a[i]) * float64(b[i])
+	}
+	return
+}
+
+// normalize scales vec to unit length in place, so that the dot product of
+// normalized vectors is their cosine similarity.
+func normalize(vec []float32) []float32 {
+	n := math.Sqrt(dot(vec, vec))
+	if n == 0 {
+		return vec
+	}
+	for i := range vec {
+		vec[i] = float32(float64(vec[i]) / n)
+	}
+	return vec
+}
+
+func (kv *KeyVal[T]) vectorField() *KeyValField[T] {
+	for _, f := range kv.opts.Fields {
+		if f.VectorDims > 0 {
+			return f
+		}
+	}
+	return nil
+}
+
+type scoredRow struct {
+	id    int64
+	score float64
+}
+
+// scored keeps the best k rows as a min-heap.
+type scored struct {
+	rows []scoredRow
+	k    int
+}
+
+func (s *scored) Len() int           { return len(s.rows) }
+func (s *scored) Less(i, j int) bool { return s.rows[i].score < s.rows[j].score }
+func (s *scored) Swap(i, j int)      { s.rows[i], s.rows[j] = s.rows[j], s.rows[i] }
+func (s *scored) Push(x any)         { s.rows = append(s.rows, x.(scoredRow)) }
+func (s *scored) Pop() any {
+	n := len(s.rows) - 1
+	x := s.rows[n]
+	s.rows = s.rows[:n]
+	return x
+}
+
+func (s *scored) add(id int64, score float64) {
+	if len(s.rows) < s.k {
+		heap.Push(s, scoredRow{id, score})
+		return
+	}
+	if score > s.rows[0].score {
+		s.rows[0] = scoredRow{id, score}
+		heap.Fix(s, 0)
+	}
+}
+
+// scanVectors scores the vectors of live rows matching cond, reading only
+// rowid and the vector column.
+func (kv *KeyVal[T]) scanVectors(query []float32, cond string, args []any, top *scored) (err error) {
+	field := kv.vectorField()
+	s := fmt.Sprintf("SELECT rowid, %s FROM %s WHERE flags & 1 = 0 AND %s IS NOT NULL",
+		field.Name, kv.tab.Name, field.Name)
+	if cond != "" {
+		s += " AND " + cond
+	}
+
+	return kv.tab.Select(s, args, func(rows *sql.Rows) (err error) {
+		var id int64
+		var buf []byte
+		err = rows.Scan(&id, &buf)
+		if err != nil {
+			return
+		}
+
+		vec, err := decodeVector(buf, field.VectorDims)
+		if err != nil {
+			return
+		}
+		if field.VectorMetric == Cosine {
+			normalize(vec)
+		}
+		top.add(id, dot(query, vec))
+		return
+	})
+}
+
+// SimilarTo returns the k live objects whose vector is most similar to vec,
+// best first, using the vector field's metric. filter may be nil.
+func (kv *KeyVal[T]) SimilarTo(vec []float32, k int, filter *VectorFilter) (list []*VectorResult[T], err error) {
+	list = make([]*VectorResult[T], 0, k)
+
+	field := kv.vectorField()
+	if field == nil {
+		return nil, fmt.Errorf("collection %s has no vector field", kv.tab.Name)
+	}
+	if len(vec) != field.VectorDims {
+		return nil, fmt.Errorf("query vector has %d dimensions, expected %d", len(vec), field.VectorDims)
+	}
+	if k <= 0 {
+		return
+	}
+
+	query := append([]float32(nil), vec...)
+	if field.VectorMetric == Cosine {
+		normalize(query)
+	}
+
+	var where string
+	var args []any
+	if filter != nil && filter.Where != "" {
+		where = "(" + filter.Where + ")"
+		args = filter.Args
+	}
+
+	top := &scored{k: k}
+	if idx := kv.vecIndex.Load(); idx != nil {
+		err = kv.searchIndex(idx, query, where, args, top)
+		if err != nil {
+			return
+		}
+	}
+
+	// Without an index, or when the probed lists hold fewer than k
+	// matches, scan everything.
+	if top.Len() < k {
+		top = &scored{k: k}
+		err = kv.scanVectors(query, where, args, top)
+		if err != nil {
+			return
+		}
+	}
+
+	sort.Slice(top.rows, func(i, j int) bool { return top.rows[i].score > top.rows[j].score })
+	ids := make([]int64, len(top.rows))
+	for i, r := range top.rows {
+		ids[i] = r.id
+	}
+
+	byId, err := kv.getByRowids(ids)
+	if err != nil {
+		return
+	}
+	for _, r := range top.rows {
+		if obj, ok := byId[r.id]; ok {
+			list = append(list, &VectorResult[T]{Obj: obj, Score: r.score})
+		}
+	}
+	return
+}
+
+type ivfIndex struct {
+	maxRowid int64
+	probes   int
+
+	// mu guards the centroids and lists, which grow as rows are written.
+	mu        sync.RWMutex
+	centroids [][]float32
+	lists     [][]int64
+}
+
+// add puts rowid in the list of the centroid nearest to vec. The first
+// vector of an empty index becomes its centroid.
+func (idx *ivfIndex) add(rowid int64, vec []float32) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	if len(idx.centroids) == 0 {
+		idx.centroids = [][]float32{vec}
+		idx.lists = [][]int64{{rowid}}
+		return
+	}
+
+	c := nearestCentroid(idx.centroids, vec)
+	idx.lists[c] = append(idx.lists[c], rowid)
+}
+
+// indexVectors adds the rows of committed events to the vector index.
+func (kv *KeyVal[T]) indexVectors(events []Event[T]) {
+	idx := kv.vecIndex.Load()
+	if idx == nil {
+		return
+	}
+	field := kv.vectorField()
+
+	for _, ev := range events {
+		if ev.New == nil || ev.Type == SoftDeleted {
+			continue
+		}
+		rowid, err := coerceInt(ev.Key)
+		if err != nil {
+			continue
+		}
+		vec, err := toVector(field.Get(ev.New))
+		if err != nil || len(vec) != field.VectorDims {
+			continue
+		}
+
+		vec = append([]float32(nil), vec...)
+		if field.VectorMetric == Cosine {
+			normalize(vec)
+		}
+		idx.add(rowid.(int64), vec)
+	}
+}
+
+// RebuildVectorIndex rebuilds the in-memory vector index from the table.
+func (kv *KeyVal[T]) RebuildVectorIndex() (err error) {
+	field := kv.vectorField()
+	if field == nil || kv.opts.VectorIndex == nil {
+		return fmt.Errorf("collection %s has no vector index", kv.tab.Name)
+	}
+	opts := *kv.opts.VectorIndex
+
+	var ids []int64
+	var vecs [][]float32
+	var maxRowid int64 = math.MinInt64
+	err = kv.tab.Select(fmt.Sprintf("SELECT rowid, %s FROM %s WHERE flags & 1 = 0 AND %s IS NOT NULL",
+		field.Name, kv.tab.Name, field.Name), nil, func(rows *sql.Rows) (err error) {
+		var id int64
+		var buf []byte
+		err = rows.Scan(&id, &buf)
+		if err != nil {
+			return
+		}
+
+		vec, err := decodeVector(buf, field.VectorDims)
+		if err != nil {
+			return
+		}
+		if field.VectorMetric == Cosine {
+			normalize(vec)
+		}
+		ids = append(ids, id)
+		vecs = append(vecs, vec)
+		return
+	})
+	if err != nil {
+		return
+	}
+
+	// Soft-deleted rows and rows without a vector are not in the index but
+	// must not be taken for new rows either.
+	err = kv.db.QueryRow(fmt.Sprintf("SELECT COALESCE(MAX(rowid), %d) FROM %s", math.MinInt64, kv.tab.Name)).
+		Scan(&maxRowid)
+	if err != nil {
+		return
+	}
+
+	nlist := opts.Lists
+	if nlist <= 0 {
+		nlist = int(math.Sqrt(float64(len(ids))))
+	}
+	nlist = max(1, min(nlist, len(ids)))
+	probes := opts.Probes
+	if probes <= 0 {
+		probes = 8
+	}
+	iterations := opts.Iterations
+	if iterations <= 0 {
+		iterations = 10
+	}
+
+	idx := &ivfIndex{maxRowid: maxRowid, probes: min(probes, nlist)}
+	if len(ids) > 0 {
+		idx.centroids = kmeans(vecs, nlist, iterations, field.VectorMetric == Cosine)
+		idx.lists = make([][]int64, len(idx.centroids))
+		for i, vec := range vecs {
+			c := nearestCentroid(idx.centroids, vec)
+			idx.lists[c] = append(idx.lists[c], ids[i])
+		}
+	}
+
+	kv.vecIndex.Store(idx)
+	return
+}
+
+func nearestCentroid(centroids [][]float32, vec []float32) (best int) {
+	bestScore := math.Inf(-1)
+	for i, c := range centroids {
+		if s := dot(c, vec); s > bestScore {
+			best, bestScore = i, s
+		}
+	}
+	return
+}
+
+// kmeans clusters vecs by dot product, which for normalized vectors is
+// spherical k-means.
+func kmeans(vecs [][]float32, k int, iterations int, normalized bool) [][]float32 {
+	rnd := rand.New(rand.NewPCG(1, 2))
+	dims := len(vecs[0])
+
+	centroids := make([][]float32, k)
+	for i, j := range rnd.Perm(len(vecs))[:k] {
+		centroids[i] = append([]float32(nil), vecs[j]...)
+	}
+
+	assign := make([]int, len(vecs))
+	for range iterations {
+		for i, vec := range vecs {
+			assign[i] = nearestCentroid(centroids, vec)
+		}
+
+		sums := make([][]float64, k)
+		counts := make([]int, k)
+		for i := range sums {
+			sums[i] = make([]float64, dims)
+		}
+		for i, vec := range vecs {
+			c := assign[i]
+			counts[c]++
+			for d, f := range vec {
+				sums[c][d] += float64(f)
+			}
+		}
+
+		for c := range centroids {
+			if counts[c] == 0 {
+				// Reseed empty lists from a random vector.
+				centroids[c] = append([]float32(nil), vecs[rnd.IntN(len(vecs))]...)
+				continue
+			}
+			for d := range dims {
+				centroids[c][d] = float32(sums[c][d] / float64(counts[c]))
+			}
+			if normalized {
+				normalize(centroids[c])
+			}
+		}
+	}
+	return centroids
+}
+
+// searchIndex scores the rows of the probed lists, and rows inserted in SQL
+// after the index was built.
+func (kv *KeyVal[T]) searchIndex(idx *ivfIndex, query []float32, where string, args []any, top *scored) error {
+	type ranked struct {
+		list  int
+		score float64
+	}
+	idx.mu.RLock()
+	order := make([]ranked, len(idx.centroids))
+	for i, c := range idx.centroids {
+		order[i] = ranked{i, dot(c, query)}
+	}
+	sort.Slice(order, func(i, j int) bool { return order[i].score > order[j].score })
+
+	var candidates []int64
+	for _, r := range order[:min(idx.probes, len(order))] {
+		candidates = append(candidates, idx.lists[r.list]...)
+	}
+	idx.mu.RUnlock()
+
+	buf, err := json.Marshal(candidates)
+	if err != nil {
+		return err
+	}
+
+	cond := "(rowid IN (SELECT value FROM json_each(?)) OR rowid > ?)"
+	if where != "" {
+		cond = strings.Join([]string{cond, where}, " AND ")
+	}
+	return kv.scanVectors(query, cond, append([]any{string(buf), idx.maxRowid}, args...), top)
+}
@@ -0,0 +1,135 @@
+package sqlitekv
+
+import (
+	"context"
+	"database/sql"
+	"math"
+	"testing"
+)
+
+type testEmbedding struct {
+	Id  int64     `json:"id"`
+	Vec []float32 `json:"vec"`
+}
+
+func embeddingOptions(t *testing.T, db *sql.DB, dims int) KeyValOptions[testEmbedding] {
+	t.Helper()
+	return KeyValOptions[testEmbedding]{
+		KeyField: &KeyValField[testEmbedding]{Name: "id", Type: "INTEGER",
+			Get: func(e *testEmbedding) any { return e.Id }, GetPtr: func(e *testEmbedding) any { return &e.Id }},
+		Fields: []*KeyValField[testEmbedding]{{Name: "vec", VectorDims: dims, Nullable: true,
+			Get: func(e *testEmbedding) any { return e.Vec }, GetPtr: func(e *testEmbedding) any { return &e.Vec }}},
+		Enc: testEncoder(t, db, EncoderOptions{}),
+	}
+}
+
+func TestVerifyVectorColumn(t *testing.T) {
+	db := openTestDB(t)
+	kv, err := NewKeyVal(db, "embeddings", embeddingOptions(t, db, 3))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, vec := range [][]float32{{1, 0, 0}, {0, 1, 0}} {
+		err = kv.Upsert(&testEmbedding{Id: int64(i + 1), Vec: vec})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	report, err := kv.Verify(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.OK() {
+		t.Errorf("report = %+v", report.Issues)
+	}
+
+	list, err := kv.SimilarTo([]float32{0.9, 0.1, 0}, 1, nil)
+	if err != nil || len(list) != 1 || list[0].Obj.Id != 1 {
+		t.Errorf("SimilarTo = %v, %v", list, err)
+	}
+}
+
+func TestVectorNeedsIntegerKey(t *testing.T) {
+	db := openTestDB(t)
+	opts := embeddingOptions(t, db, 3)
+	opts.KeyField.Type = "TEXT"
+	_, err := NewKeyVal(db, "embeddings", opts)
+	if err == nil {
+		t.Error("vector field with a TEXT key was accepted")
+	}
+}
+
+func angleVector(deg float64) []float32 {
+	rad := deg * math.Pi / 180
+	return []float32{float32(math.Cos(rad)), float32(math.Sin(rad))}
+}
+
+func TestVectorIndexWritesAfterBuild(t *testing.T) {
+	db := openTestDB(t)
+	opts := embeddingOptions(t, db, 2)
+	kv, err := NewKeyVal(db, "embeddings", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range 50 {
+		err = kv.Upsert(&testEmbedding{Id: int64(10 + i), Vec: angleVector(float64(i) * 7.2)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Row 7 is soft-deleted and row 8 has no vector when the index is built.
+	err = kv.Upsert(&testEmbedding{Id: 7, Vec: angleVector(3.6)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = kv.SoftDelete(int64(7))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = kv.Upsert(&testEmbedding{Id: 8})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts.VectorIndex = &VectorIndexOptions{Lists: 5, Probes: 1}
+	kv, err = NewKeyVal(db, "embeddings", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nearest := func(deg float64) int64 {
+		t.Helper()
+		list, err := kv.SimilarTo(angleVector(deg), 1, nil)
+		if err != nil || len(list) != 1 {
+			t.Fatalf("SimilarTo = %v, %v", list, err)
+		}
+		return list[0].Obj.Id
+	}
+
+	_, err = kv.Undelete(int64(7))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id := nearest(3.6); id != 7 {
+		t.Errorf("undeleted row not found, got %d", id)
+	}
+
+	err = kv.Upsert(&testEmbedding{Id: 8, Vec: angleVector(93.6)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id := nearest(93.6); id != 8 {
+		t.Errorf("row given a vector not found, got %d", id)
+	}
+
+	// Rowids below the largest at build time are reused.
+	err = kv.Upsert(&testEmbedding{Id: 5, Vec: angleVector(183.6)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id := nearest(183.6); id != 5 {
+		t.Errorf("row inserted with a lower rowid not found, got %d", id)
+	}
+}
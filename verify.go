@@ -0,0 +1,377 @@
+package sqlitekv
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+type VerifyIssue struct {
+	PKey any
+	// Column is empty when the value itself is bad.
+	Column string
+	Reason string
+}
+
+type VerifyReport struct {
+	Rows           int64
+	IntegrityCheck []string
+	MissingDicts   []uint32
+	Issues         []VerifyIssue
+}
+
+func (r *VerifyReport) OK() bool {
+	return len(r.IntegrityCheck) == 0 && len(r.MissingDicts) == 0 && len(r.Issues) == 0
+}
+
+func (r *VerifyReport) BadKeys() (keys []any) {
+	// Keys can be []byte, which can't be map keys.
+	seen := make(map[string]bool)
+	for _, issue := range r.Issues {
+		k := fmt.Sprintf("%T:%v", issue.PKey, issue.PKey)
+		if !seen[k] {
+			seen[k] = true
+			keys = append(keys, issue.PKey)
+		}
+	}
+	return
+}
+
+// Verify checks the database with PRAGMA integrity_check, that every
+// dictionary version referenced by the collection exists, and that every
+// row, soft-deleted or not, decodes and has indexed columns matching the
+// decoded object. Problems are collected in the report; err is only set when
+// the check itself could not run.
+func (kv *KeyVal[T]) Verify(ctx context.Context) (report *VerifyReport, err error) {
+	report = &VerifyReport{}
+
+	report.IntegrityCheck, err = integrityCheck(ctx, kv.db)
+	if err != nil {
+		return
+	}
+
+	report.MissingDicts, err = kv.missingDicts(ctx)
+	if err != nil {
+		return
+	}
+
+	err = kv.verifyRows(ctx, report)
+	return
+}
+
+// integrityCheck runs PRAGMA integrity_check. Comparing path indexes with
+// their tables evaluates kv_extract, so on connections without the kv
+// functions, e.g. while validating a restore, those tables only get
+// quick_check, which checks the file but not index contents.
+func integrityCheck(ctx context.Context, db *sql.DB) (problems []string, err error) {
+	exprTables, err := pathIndexTables(ctx, db)
+	if err != nil {
+		return
+	}
+	if len(exprTables) == 0 {
+		return pragmaCheck(ctx, db, "PRAGMA integrity_check")
+	}
+	_, err = db.ExecContext(ctx, `SELECT kv_extract(NULL, 0, '', '$')`)
+	if err == nil {
+		return pragmaCheck(ctx, db, "PRAGMA integrity_check")
+	}
+
+	problems, err = pragmaCheck(ctx, db, "PRAGMA quick_check")
+	if err != nil {
+		return
+	}
+
+	tables, err := schemaTables(ctx, db)
+	if err != nil {
+		return
+	}
+	for _, name := range tables {
+		if exprTables[name] {
+			continue
+		}
+		var more []string
+		more, err = pragmaCheck(ctx, db, fmt.Sprintf(`PRAGMA integrity_check("%s")`, name))
+		if err != nil {
+			return
+		}
+		problems = append(problems, more...)
+	}
+	return
+}
+
+func pathIndexTables(ctx context.Context, db *sql.DB) (tables map[string]bool, err error) {
+	rows, err := db.QueryContext(ctx, `SELECT DISTINCT tbl_name FROM sqlite_schema
+		WHERE type = 'index' AND sql LIKE '%kv_extract(%'`)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	tables = make(map[string]bool)
+	for rows.Next() {
+		var name string
+		err = rows.Scan(&name)
+		if err != nil {
+			return
+		}
+		tables[name] = true
+	}
+
+	err = rows.Err()
+	return
+}
+
+func pragmaCheck(ctx context.Context, db *sql.DB, pragma string) (problems []string, err error) {
+	rows, err := db.QueryContext(ctx, pragma)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var line string
+		err = rows.Scan(&line)
+		if err != nil {
+			return
+		}
+		if line != "ok" {
+			problems = append(problems, line)
+		}
+	}
+
+	err = rows.Err()
+	return
+}
+
+func (kv *KeyVal[T]) missingDicts(ctx context.Context) (missing []uint32, err error) {
+	rows, err := kv.db.QueryContext(ctx, fmt.Sprintf(`SELECT DISTINCT (flags & %d) >> %d FROM %s
+		WHERE flags & %d != 0 ORDER BY 1`, DictIDMask, DictIDShift, kv.tab.Name, EncodeFlagUseDict))
+	if err != nil {
+		return
+	}
+
+	var vers []uint32
+	for rows.Next() {
+		var ver uint32
+		err = rows.Scan(&ver)
+		if err != nil {
+			rows.Close()
+			return
+		}
+		vers = append(vers, ver)
+	}
+	rows.Close()
+	err = rows.Err()
+	if err != nil || len(vers) == 0 {
+		return
+	}
+
+	dictColl := kv.opts.Enc.DictCollection()
+	if dictColl == nil {
+		missing = vers
+		return
+	}
+
+	for _, ver := range vers {
+		var ok bool
+		ok, _, err = dictColl.Get(kv.dictKey, ver)
+		if err != nil {
+			return
+		}
+		if !ok {
+			missing = append(missing, ver)
+		}
+	}
+	return
+}
+
+func (kv *KeyVal[T]) verifyRows(ctx context.Context, report *VerifyReport) (err error) {
+	s := strings.Builder{}
+	s.WriteString("SELECT ")
+	s.WriteString(kv.opts.KeyField.Name)
+	s.WriteString(", flags")
+	for _, f := range kv.opts.Fields {
+		s.WriteString(", ")
+		s.WriteString(f.Name)
+	}
+	s.WriteString(", val FROM ")
+	s.WriteString(kv.tab.Name)
+	s.WriteString(" ORDER BY rowid")
+
+	rows, err := kv.db.QueryContext(ctx, s.String())
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var flags int64
+		var buf []byte
+		cols := make([]any, len(kv.opts.Fields))
+		obj := new(T)
+
+		scanArgs := make([]any, len(kv.opts.Fields)+3)
+		scanArgs[0] = kv.opts.KeyField.GetPtr(obj)
+		scanArgs[1] = &flags
+		for i := range kv.opts.Fields {
+			scanArgs[i+2] = &cols[i]
+		}
+		scanArgs[len(kv.opts.Fields)+2] = &buf
+
+		err = rows.Scan(scanArgs...)
+		if err != nil {
+			return
+		}
+		report.Rows++
+
+		pkey := kv.opts.KeyField.Get(obj)
+		err = kv.decode(buf, flags, obj)
+		if err != nil {
+			report.Issues = append(report.Issues, VerifyIssue{PKey: pkey, Reason: err.Error()})
+			err = nil
+			continue
+		}
+
+		for i, f := range kv.opts.Fields {
+			reason := kv.verifyColumn(f, obj, cols[i])
+			if reason != "" {
+				report.Issues = append(report.Issues, VerifyIssue{PKey: pkey, Column: f.Name, Reason: reason})
+			}
+		}
+	}
+
+	err = rows.Err()
+	return
+}
+
+func (kv *KeyVal[T]) verifyColumn(field *KeyValField[T], obj *T, stored any) (reason string) {
+	want := field.Get(obj)
+	if isNil(want) || stored == nil {
+		if isNil(want) != (stored == nil) {
+			reason = fmt.Sprintf("column is %v, decoded value is %v", stored, want)
+		}
+		return
+	}
+
+	switch {
+	case field.BlindIndex:
+		sum, err := kv.opts.Enc.blindIndex(kv.tab.Name, field.Name, want)
+		if err != nil {
+			return err.Error()
+		}
+		if b, ok := stored.([]byte); !ok || !bytes.Equal(b, sum) {
+			reason = "blind index does not match decoded value"
+		}
+
+	case field.Encrypted:
+		b, ok := stored.([]byte)
+		if !ok {
+			return "encrypted column is not a blob"
+		}
+
+		ad, err := kv.fieldAssocData(field, kv.opts.KeyField.Get(obj))
+		if err != nil {
+			return err.Error()
+		}
+
+		got, err := kv.opts.Enc.decryptField(b, ad)
+		if err != nil {
+			return err.Error()
+		}
+
+		wantBuf, err := cbor.Marshal(want)
+		if err != nil {
+			return err.Error()
+		}
+		if !bytes.Equal(got, wantBuf) {
+			reason = "encrypted column does not match decoded value"
+		}
+
+	case field.Geo:
+		col, err := geoColumnValue(want)
+		if err != nil {
+			return err.Error()
+		}
+		if !sameValue(stored, col) {
+			reason = fmt.Sprintf("column is %v, decoded value is %v", stored, col)
+		}
+
+	case field.VectorDims > 0:
+		col, err := vectorColumnValue(want, field.VectorDims)
+		if err != nil {
+			return err.Error()
+		}
+		if !sameValue(stored, col) {
+			reason = "vector column does not match decoded value"
+		}
+
+	default:
+		if !sameValue(stored, want) {
+			reason = fmt.Sprintf("column is %v, decoded value is %v", stored, want)
+		}
+	}
+	return
+}
+
+func isNil(v any) bool {
+	if v == nil {
+		return true
+	}
+	rv := reflect.ValueOf(v)
+	return rv.Kind() == reflect.Pointer && rv.IsNil()
+}
+
+// sameValue compares a column as read back from SQLite with the Go value it
+// was written from, allowing for SQLite's type affinity.
+func sameValue(stored any, want any) bool {
+	rv := reflect.ValueOf(want)
+	for rv.Kind() == reflect.Pointer {
+		rv = rv.Elem()
+	}
+
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if n, ok := stored.(int64); ok {
+			return n == rv.Int()
+		}
+		return sameNumber(stored, float64(rv.Int()))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if n, ok := stored.(int64); ok {
+			return n >= 0 && uint64(n) == rv.Uint()
+		}
+		return sameNumber(stored, float64(rv.Uint()))
+	case reflect.Float32, reflect.Float64:
+		return sameNumber(stored, rv.Float())
+	case reflect.Bool:
+		return sameNumber(stored, map[bool]float64{false: 0, true: 1}[rv.Bool()])
+	case reflect.String:
+		switch s := stored.(type) {
+		case string:
+			return s == rv.String()
+		case []byte:
+			return string(s) == rv.String()
+		}
+	case reflect.Slice:
+		if b, ok := stored.([]byte); ok && rv.Type().Elem().Kind() == reflect.Uint8 {
+			return bytes.Equal(b, rv.Bytes())
+		}
+	}
+	return fmt.Sprint(stored) == fmt.Sprint(rv.Interface())
+}
+
+func sameNumber(stored any, want float64) bool {
+	switch n := stored.(type) {
+	case int64:
+		return float64(n) == want
+	case float64:
+		return n == want
+	case bool:
+		return (n && want == 1) || (!n && want == 0)
+	}
+	return false
+}
@@ -0,0 +1,113 @@
+package sqlitekv
+
+import (
+	"context"
+	"slices"
+	"testing"
+)
+
+func openVerifyUsers(t *testing.T) *KeyVal[testUser] {
+	t.Helper()
+	db := openTestDB(t)
+	kv, err := NewKeyVal(db, "users", KeyValOptions[testUser]{
+		KeyField:    userKeyField(),
+		Fields:      []*KeyValField[testUser]{emailField()},
+		Enc:         testEncoder(t, db, EncoderOptions{}),
+		Compression: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, u := range []*testUser{{Id: 1, Name: "alice", Email: "a@example.com"}, {Id: 2, Name: "bob", Email: "b@example.com"}} {
+		err = kv.Upsert(u)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return kv
+}
+
+func TestVerify(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		sql    string
+		column string
+	}{
+		{"ok", "", ""},
+		{"corrupt value", "UPDATE users SET val = x'00ff00ff' WHERE id = 2", ""},
+		{"mismatched column", "UPDATE users SET email = 'x@example.com' WHERE id = 2", "email"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			kv := openVerifyUsers(t)
+			if tc.sql != "" {
+				_, err := kv.db.Exec(tc.sql)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			report, err := kv.Verify(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if report.Rows != 2 {
+				t.Errorf("Rows = %d", report.Rows)
+			}
+			if tc.sql == "" {
+				if !report.OK() {
+					t.Errorf("report is not OK: %+v", report)
+				}
+				return
+			}
+
+			if len(report.Issues) != 1 || report.Issues[0].PKey != int64(2) || report.Issues[0].Column != tc.column {
+				t.Errorf("Issues = %+v", report.Issues)
+			}
+		})
+	}
+}
+
+func TestVerifyMissingDict(t *testing.T) {
+	db := openTestDB(t)
+	enc := testEncoder(t, db, EncoderOptions{})
+	kv := openDictUsers(t, db, enc, "users", "")
+	_, err := enc.DictCollection().Import(kv.DictKey(), testDict(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = kv.UseLatestDict()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = kv.Upsert(&testUser{Id: 1, Name: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = db.Exec("DELETE FROM comp_dict")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := kv.Verify(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(report.MissingDicts, []uint32{1}) {
+		t.Errorf("MissingDicts = %v", report.MissingDicts)
+	}
+}
+
+func TestBadKeys(t *testing.T) {
+	report := VerifyReport{Issues: []VerifyIssue{
+		{PKey: []byte("a"), Column: "email"},
+		{PKey: []byte("a")},
+		{PKey: "a"},
+		{PKey: []byte("b")},
+	}}
+	keys := report.BadKeys()
+	if len(keys) != 3 {
+		t.Errorf("BadKeys = %v", keys)
+	}
+}
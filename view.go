@@ -0,0 +1,57 @@
+package sqlitekv
+
+import (
+	"fmt"
+	"strings"
+)
+
+func (kv *KeyVal[T]) JSONViewName() string {
+	return kv.tab.Name + "_json"
+}
+
+func (kv *KeyVal[T]) jsonViewSql() string {
+	s := strings.Builder{}
+	s.WriteString("CREATE VIEW ")
+	s.WriteString(kv.JSONViewName())
+	s.WriteString(" AS SELECT ")
+	s.WriteString(kv.opts.KeyField.Name)
+	for _, f := range kv.opts.Fields {
+		// Encrypted and blind-indexed columns don't hold the plain value.
+		if f.Encrypted || f.BlindIndex {
+			continue
+		}
+		s.WriteString(", ")
+		s.WriteString(f.Name)
+	}
+	s.WriteString(", flags & 1 AS deleted, ")
+	s.WriteString(kv.DecodeSQL())
+	s.WriteString(" AS doc FROM ")
+	s.WriteString(kv.tab.Name)
+	return s.String()
+}
+
+// syncJSONView rebuilds the JSON view when the collection's catalog entry
+// changed or the view is missing, and drops it when it is turned off.
+func (kv *KeyVal[T]) syncJSONView(changed bool) (err error) {
+	name := kv.JSONViewName()
+
+	var n int
+	err = kv.db.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type = 'view' AND name = ?`, name).Scan(&n)
+	if err != nil {
+		return
+	}
+	exists := n > 0
+
+	if exists && (changed || !kv.opts.JSONView) {
+		_, err = kv.db.Exec(fmt.Sprintf("DROP VIEW %s", name))
+		if err != nil {
+			return
+		}
+		exists = false
+	}
+
+	if kv.opts.JSONView && !exists {
+		_, err = kv.db.Exec(kv.jsonViewSql())
+	}
+	return
+}
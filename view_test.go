@@ -0,0 +1,68 @@
+package sqlitekv
+
+import (
+	"database/sql"
+	"encoding/json"
+	"testing"
+)
+
+func TestJSONView(t *testing.T) {
+	// The view is created on a connection without the kv functions; reading
+	// it needs a connection that has them.
+	db := openTestDB(t)
+	opts := KeyValOptions[testUser]{
+		KeyField:    userKeyField(),
+		Fields:      []*KeyValField[testUser]{emailField()},
+		Enc:         testEncoder(t, db, EncoderOptions{}),
+		Compression: true,
+		JSONView:    true,
+	}
+	kv, err := NewKeyVal(db, "users", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = kv.Upsert(&testUser{Id: 1, Name: "alice", Email: "a@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var doc string
+	err = db.QueryRow("SELECT doc FROM users_json").Scan(&doc)
+	if err == nil {
+		t.Error("view read without the kv functions")
+	}
+
+	var path string
+	err = db.QueryRow("SELECT file FROM pragma_database_list WHERE name = 'main'").Scan(&path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	funcDB, err := sql.Open("sqlite3_kv_test", "file:"+path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer funcDB.Close()
+
+	var email string
+	var deleted int
+	err = funcDB.QueryRow("SELECT email, deleted, doc FROM users_json WHERE id = 1").Scan(&email, &deleted, &doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var u testUser
+	err = json.Unmarshal([]byte(doc), &u)
+	if err != nil || u != (testUser{Id: 1, Name: "alice", Email: "a@example.com"}) || email != u.Email || deleted != 0 {
+		t.Errorf("view row = %q, %d, %s (%v)", email, deleted, doc, err)
+	}
+
+	opts.JSONView = false
+	_, err = NewKeyVal(db, "users", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var n int
+	err = db.QueryRow("SELECT COUNT(*) FROM sqlite_schema WHERE name = 'users_json'").Scan(&n)
+	if err != nil || n != 0 {
+		t.Errorf("view not dropped: %d, %v", n, err)
+	}
+}
@@ -0,0 +1,437 @@
+package sqlitekv
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"slices"
+	"sync"
+	"sync/atomic"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+type EventType int
+
+const (
+	// Inserted is also sent for undeleted rows and for upserts over
+	// soft-deleted rows.
+	Inserted EventType = iota + 1
+	Updated
+	Deleted
+	SoftDeleted
+)
+
+func (t EventType) String() string {
+	switch t {
+	case Inserted:
+		return "inserted"
+	case Updated:
+		return "updated"
+	case Deleted:
+		return "deleted"
+	case SoftDeleted:
+		return "soft_deleted"
+	}
+	return fmt.Sprintf("EventType(%d)", int(t))
+}
+
+// Event is a committed change made through a KeyVal. Old is the value
+// before the change and New after it, when there is one.
+type Event[T any] struct {
+	Type EventType
+	Key  any
+	Old  *T
+	New  *T
+
+	// op is the write that produced the event, for the audit log.
+	op ChangeOp
+}
+
+// BufferPolicy decides what happens when a watcher's buffer is full.
+type BufferPolicy int
+
+const (
+	// WatchDrop drops the event for that watcher.
+	WatchDrop BufferPolicy = iota
+	// WatchBlock makes the writer wait until the watcher catches up or its
+	// context ends.
+	WatchBlock
+	// WatchDisconnect closes the watcher's channel.
+	WatchDisconnect
+)
+
+type WatchFilter[T any] struct {
+	// Types selects event types; empty means all.
+	Types []EventType
+	Match func(ev *Event[T]) bool
+	// Buffer is the channel size, 64 by default.
+	Buffer int
+	Policy BufferPolicy
+}
+
+type watcher[T any] struct {
+	ctx    context.Context
+	filter WatchFilter[T]
+	ch     chan Event[T]
+
+	mu     sync.Mutex
+	closed bool
+}
+
+func (w *watcher[T]) wants(ev *Event[T]) bool {
+	if len(w.filter.Types) > 0 && !slices.Contains(w.filter.Types, ev.Type) {
+		return false
+	}
+	return w.filter.Match == nil || w.filter.Match(ev)
+}
+
+// send delivers ev and reports whether the watcher must be disconnected.
+func (w *watcher[T]) send(ev Event[T]) (disconnect bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return false
+	}
+
+	select {
+	case w.ch <- ev:
+		return false
+	default:
+	}
+
+	switch w.filter.Policy {
+	case WatchBlock:
+		select {
+		case w.ch <- ev:
+		case <-w.ctx.Done():
+		}
+	case WatchDisconnect:
+		w.closed = true
+		close(w.ch)
+		return true
+	}
+	return false
+}
+
+func (w *watcher[T]) close() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.closed {
+		w.closed = true
+		close(w.ch)
+	}
+}
+
+type watchHub[T any] struct {
+	mu       sync.Mutex
+	watchers map[*watcher[T]]struct{}
+	n        atomic.Int32
+
+	// Writers take a ticket while they hold the database's write lock, so
+	// tickets follow commit order, and handle their events in ticket order.
+	order   sync.Mutex
+	turn    *sync.Cond
+	tickets uint64
+	next    uint64
+}
+
+func (h *watchHub[T]) ticket() (t uint64) {
+	h.order.Lock()
+	defer h.order.Unlock()
+	t = h.tickets
+	h.tickets++
+	return
+}
+
+// inTurn runs fn once the writers with earlier tickets are done.
+func (h *watchHub[T]) inTurn(t uint64, fn func()) {
+	h.order.Lock()
+	if h.turn == nil {
+		h.turn = sync.NewCond(&h.order)
+	}
+	for h.next != t {
+		h.turn.Wait()
+	}
+	h.order.Unlock()
+
+	defer func() {
+		h.order.Lock()
+		h.next++
+		h.turn.Broadcast()
+		h.order.Unlock()
+	}()
+	fn()
+}
+
+func (h *watchHub[T]) add(w *watcher[T]) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.watchers == nil {
+		h.watchers = make(map[*watcher[T]]struct{})
+	}
+	h.watchers[w] = struct{}{}
+	h.n.Store(int32(len(h.watchers)))
+}
+
+func (h *watchHub[T]) remove(w *watcher[T]) {
+	h.mu.Lock()
+	delete(h.watchers, w)
+	h.n.Store(int32(len(h.watchers)))
+	h.mu.Unlock()
+	w.close()
+}
+
+func (h *watchHub[T]) active() bool {
+	return h.n.Load() > 0
+}
+
+func (h *watchHub[T]) publish(events []Event[T]) {
+	if len(events) == 0 || !h.active() {
+		return
+	}
+
+	h.mu.Lock()
+	watchers := make([]*watcher[T], 0, len(h.watchers))
+	for w := range h.watchers {
+		watchers = append(watchers, w)
+	}
+	h.mu.Unlock()
+
+	for _, w := range watchers {
+		for i := range events {
+			if !w.wants(&events[i]) {
+				continue
+			}
+			if w.send(events[i]) {
+				h.remove(w)
+				break
+			}
+		}
+	}
+}
+
+// Watch returns a channel of the changes made through this KeyVal that
+// match filter. Events are sent after the change commits, in commit order.
+// The channel is closed when ctx ends, or when the buffer overflows with
+// WatchDisconnect. A writer blocked by WatchBlock also holds up the events
+// of later writers.
+//
+// While anyone watches, writes run in a transaction that also reads the
+// old value.
+func (kv *KeyVal[T]) Watch(ctx context.Context, filter WatchFilter[T]) <-chan Event[T] {
+	size := filter.Buffer
+	if size <= 0 {
+		size = 64
+	}
+
+	w := &watcher[T]{ctx: ctx, filter: filter, ch: make(chan Event[T], size)}
+	kv.watch.add(w)
+
+	go func() {
+		<-ctx.Done()
+		kv.watch.remove(w)
+	}()
+	return w.ch
+}
+
+// tracking reports whether writes must go through inTx, for watchers, the
+// audit log or the vector index.
+func (kv *KeyVal[T]) tracking() bool {
+	return kv.watch.active() || kv.opts.Audit != nil || kv.opts.VectorIndex != nil
+}
+
+// inTx runs fn in a transaction, records its events in the audit log, and
+// after commit adds them to the vector index and publishes them, in commit
+// order.
+func (kv *KeyVal[T]) inTx(ctx context.Context, fn func(tx *sql.Tx) ([]Event[T], error)) (err error) {
+	// Statements are prepared on the pool, which must not wait for the
+	// connection held by the transaction.
+	_, err = kv.oldStmt()
+	if err != nil {
+		return
+	}
+	_, err = kv.tab.insertStmt()
+	if err != nil {
+		return
+	}
+	_, err = kv.tab.upsertStmt()
+	if err != nil {
+		return
+	}
+	var info AuditInfo
+	if kv.opts.Audit != nil {
+		info, err = kv.auditInfo(ctx)
+		if err != nil {
+			return
+		}
+		_, err = kv.auditStmt()
+		if err != nil {
+			return
+		}
+	}
+
+	tx, err := kv.db.BeginTx(ctx, nil)
+	if err != nil {
+		return
+	}
+	defer tx.Rollback()
+
+	events, err := fn(tx)
+	if err != nil {
+		return
+	}
+
+	if kv.opts.Audit != nil {
+		err = kv.writeAudit(ctx, tx, info, events)
+		if err != nil {
+			return
+		}
+	}
+
+	if len(events) == 0 {
+		return tx.Commit()
+	}
+
+	// fn has written, so the transaction holds the write lock until it ends.
+	t := kv.watch.ticket()
+	err = tx.Commit()
+	kv.watch.inTurn(t, func() {
+		if err == nil {
+			kv.indexVectors(events)
+			kv.watch.publish(events)
+		}
+	})
+	return
+}
+
+func (kv *KeyVal[T]) oldStmt() (*sql.Stmt, error) {
+	return kv.tab.StmtStore().GetOrCreate(kv.db, "get_any_pkey", func() string {
+		return fmt.Sprintf("SELECT flags, val FROM %s WHERE %s = ?", kv.tab.Name, kv.opts.KeyField.Name)
+	})
+}
+
+// readOld returns the stored value of pkey, soft-deleted or not.
+func (kv *KeyVal[T]) readOld(ctx context.Context, tx *sql.Tx, pkey any) (obj *T, deleted bool, err error) {
+	stmt, err := kv.oldStmt()
+	if err != nil {
+		return
+	}
+
+	var flags int64
+	var buf []byte
+	err = tx.StmtContext(ctx, stmt).QueryRowContext(ctx, pkey).Scan(&flags, &buf)
+	if err == sql.ErrNoRows {
+		return nil, false, nil
+	}
+	if err != nil {
+		return
+	}
+
+	opts, err := kv.decodeOptions(flags, pkey)
+	if err != nil {
+		return
+	}
+
+	obj = new(T)
+	err = kv.opts.Enc.Decode(buf, obj, flags, opts)
+	deleted = flags&EncodeSoftDelete != 0
+	return
+}
+
+// upsertTx upserts a row and returns its event, or nil when the row is
+// soft-deleted before and after.
+func (kv *KeyVal[T]) upsertTx(ctx context.Context, tx *sql.Tx, obj *T, args []any) (ev *Event[T], err error) {
+	key := args[0]
+	old, deleted, err := kv.readOld(ctx, tx, key)
+	if err != nil {
+		return
+	}
+
+	stmt, err := kv.tab.upsertStmt()
+	if err != nil {
+		return
+	}
+
+	_, err = tx.StmtContext(ctx, stmt).ExecContext(ctx, args...)
+	if err != nil {
+		return
+	}
+
+	newObj, err := clone(obj)
+	if err != nil {
+		return
+	}
+
+	ev = &Event[T]{Type: Updated, Key: key, Old: old, New: newObj, op: OpUpdate}
+	switch {
+	case args[1].(int64)&EncodeSoftDelete != 0:
+		if old == nil || deleted {
+			return nil, nil
+		}
+		ev.Type, ev.op = SoftDeleted, OpSoftDelete
+	case old == nil:
+		ev.Type, ev.op = Inserted, OpInsert
+	case deleted:
+		ev.Type, ev.op = Inserted, OpUndelete
+		ev.Old = nil
+	}
+	return
+}
+
+// execKey runs a statement that changes the row of pkey. For OpUndelete
+// the old value becomes the new one.
+func (kv *KeyVal[T]) execKey(ctx context.Context, stmt *sql.Stmt, pkey any, op ChangeOp) (affectedCount int64, err error) {
+	if !kv.tracking() {
+		var res sql.Result
+		res, err = stmt.ExecContext(ctx, pkey)
+		if err != nil {
+			return
+		}
+		return res.RowsAffected()
+	}
+
+	err = kv.inTx(ctx, func(tx *sql.Tx) (events []Event[T], err error) {
+		old, _, err := kv.readOld(ctx, tx, pkey)
+		if err != nil {
+			return
+		}
+
+		res, err := tx.StmtContext(ctx, stmt).ExecContext(ctx, pkey)
+		if err != nil {
+			return
+		}
+
+		affectedCount, err = res.RowsAffected()
+		if err != nil || affectedCount == 0 {
+			return
+		}
+
+		ev := Event[T]{Key: pkey, Old: old, op: op}
+		switch op {
+		case OpSoftDelete:
+			ev.Type = SoftDeleted
+		case OpUndelete:
+			ev.Type = Inserted
+			ev.Old, ev.New = nil, old
+		default:
+			ev.Type = Deleted
+		}
+		events = append(events, ev)
+		return
+	})
+	return
+}
+
+// clone returns a deep copy of obj, so that events don't share the caller's
+// object. It goes through CBOR like a stored value, so the copy is what a
+// read would return.
+func clone[T any](obj *T) (c *T, err error) {
+	buf, err := cbor.Marshal(obj)
+	if err != nil {
+		return
+	}
+	c = new(T)
+	err = unmarshalValue(buf, c)
+	return
+}
@@ -0,0 +1,106 @@
+package sqlitekv
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+type watchDoc struct {
+	Id   int64    `json:"id"`
+	Tags []string `json:"tags"`
+}
+
+func openWatchDocs(t *testing.T, db *sql.DB) *KeyVal[watchDoc] {
+	t.Helper()
+	kv, err := NewKeyVal(db, "docs", KeyValOptions[watchDoc]{
+		KeyField: &KeyValField[watchDoc]{
+			Name: "id",
+			Type: "INTEGER",
+			Get:  func(d *watchDoc) any { return d.Id },
+		},
+		Enc: testEncoder(t, db, EncoderOptions{}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return kv
+}
+
+func TestWatchEventsAreCopies(t *testing.T) {
+	kv := openWatchDocs(t, openTestDB(t))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := kv.Watch(ctx, WatchFilter[watchDoc]{})
+
+	doc := &watchDoc{Id: 1, Tags: []string{"a"}}
+	_, err := kv.Insert(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc.Tags[0] = "b"
+	err = kv.Upsert(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc.Tags[0] = "c"
+
+	for _, want := range []string{"a", "b"} {
+		ev := <-ch
+		if got := ev.New.Tags[0]; got != want {
+			t.Errorf("%v event has tag %q, want %q", ev.Type, got, want)
+		}
+	}
+}
+
+func TestWatchCommitOrder(t *testing.T) {
+	kv := openWatchDocs(t, openTestDB(t))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	const writers, writes = 8, 50
+	ch := kv.Watch(ctx, WatchFilter[watchDoc]{
+		Buffer: writers * writes,
+		// Delays publishing by a varying time, so writers that committed
+		// later can catch up.
+		Match: func(ev *Event[watchDoc]) bool {
+			time.Sleep(time.Duration(len(ev.New.Tags[0])%2) * time.Millisecond)
+			return true
+		},
+	})
+
+	var wg sync.WaitGroup
+	errs := make(chan error, writers)
+	for i := range writers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range writes {
+				err := kv.Upsert(&watchDoc{Id: 1, Tags: []string{fmt.Sprintf("%d-%d", i, j)}})
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	// Each write reads the value it replaces in its transaction, so in
+	// commit order every event's Old is the previous event's New.
+	var last *watchDoc
+	for range writers * writes {
+		ev := <-ch
+		if last != nil && (ev.Old == nil || ev.Old.Tags[0] != last.Tags[0]) {
+			t.Fatalf("event replacing %v follows %v", ev.Old, last)
+		}
+		last = ev.New
+	}
+}